@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/andrewstucki/light/tunnel"
+	"github.com/spf13/cobra"
+)
+
+var tcpCmd = &cobra.Command{
+	Use:   "tcp <port>",
+	Short: "Expose a local TCP port.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		forward(tunnel.ProtocolTCP, args[0])
+	},
+}
+
+var udpCmd = &cobra.Command{
+	Use:   "udp <port>",
+	Short: "Expose a local UDP port.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		forward(tunnel.ProtocolUDP, args[0])
+	},
+}
+
+func forward(protocol tunnel.Protocol, portValue string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid port value")
+		os.Exit(1)
+	}
+	local := "localhost:" + strconv.Itoa(port)
+
+	if err := tunnel.Connect(ctx, tunnel.Config{
+		Server:               server,
+		GRPCPort:             serverGRPCPort,
+		Proxy:                outboundProxy,
+		ID:                   id,
+		Token:                token,
+		Protocol:             protocol,
+		Address:              local,
+		Strategy:             tunnel.Strategy(strategy),
+		Standby:              standby,
+		Compression:          compression,
+		CompressionThreshold: compressionThreshold,
+		Connected: func(address string) {
+			log.Printf("Forwarding %s/%s to %s", address, protocol, local)
+		},
+	}); err != nil {
+		if !strings.Contains(err.Error(), "context canceled") {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+}
+
+func init() {
+	addClientFlags(tcpCmd.Flags())
+	addClientFlags(udpCmd.Flags())
+
+	rootCmd.AddCommand(tcpCmd)
+	rootCmd.AddCommand(udpCmd)
+}
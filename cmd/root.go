@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/andrewstucki/light/tunnel"
 	"github.com/spf13/cobra"
@@ -45,6 +48,14 @@ var rootCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		proxy := httputil.NewSingleHostReverseProxy(local)
+		handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if tunnel.Forwarded(request) {
+				// the server already added the visitor at the edge, without
+				// a remote address the proxy won't append them a second time
+				request.RemoteAddr = ""
+			}
+			proxy.ServeHTTP(response, request)
+		})
 
 		group, ctx := errgroup.WithContext(ctx)
 
@@ -70,13 +81,33 @@ var rootCmd = &cobra.Command{
 			})
 		}
 
+		config := tunnel.Config{
+			Server:               server,
+			GRPCPort:             serverGRPCPort,
+			Proxy:                outboundProxy,
+			ID:                   id,
+			Handler:              handler,
+			Token:                token,
+			Strategy:             tunnel.Strategy(strategy),
+			Standby:              standby,
+			Timeout:              timeout,
+			Compression:          compression,
+			CompressionThreshold: compressionThreshold,
+		}
+		if tlsCertificate != "" || tlsKey != "" {
+			certificate, err := tls.LoadX509KeyPair(tlsCertificate, tlsKey)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+			config.Protocol = tunnel.ProtocolTLS
+			config.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{certificate},
+			}
+		}
+
 		group.Go(func() error {
-			return tunnel.Connect(ctx, tunnel.Config{
-				Server:  server,
-				ID:      id,
-				Handler: proxy,
-				Token:   token,
-			})
+			return tunnel.Connect(ctx, config)
 		})
 
 		if err := group.Wait(); err != nil {
@@ -96,17 +127,44 @@ func Execute() {
 }
 
 var (
-	localPort int
-	server    string
-	id        string
-	token     string
+	localPort      int
+	server         string
+	serverGRPCPort int
+	outboundProxy  string
+	id             string
+	token          string
+	strategy       string
+	standby        bool
+	tlsCertificate string
+	tlsKey         string
+	timeout        time.Duration
+
+	compression          []string
+	compressionThreshold int
 )
 
 func init() {
 	rootCmd.Flags().IntVarP(&localPort, "port", "p", 0, "Local port to proxy to.")
-	rootCmd.Flags().StringVarP(&server, "server", "s", "http://localhost", "Server connection string")
-	rootCmd.Flags().StringVarP(&token, "token", "t", "", "Token to use on connect.")
-	rootCmd.Flags().StringVarP(&id, "id", "i", "", "id to use for connection")
+	rootCmd.Flags().StringVarP(&tlsCertificate, "tls-cert", "", "", "Certificate to terminate TLS with locally, enables TLS passthrough.")
+	rootCmd.Flags().DurationVarP(&timeout, "timeout", "", 0, "How long the server waits on a response to start before giving up, can't exceed the server's own timeout.")
+	rootCmd.Flags().StringVarP(&tlsKey, "tls-key", "", "", "Private key for the TLS passthrough certificate.")
+	addClientFlags(rootCmd.Flags())
+}
+
+func addCompressionFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(&compression, "compression", "", []string{tunnel.EncodingZstd, tunnel.EncodingGzip}, "Encodings bodies can be compressed with over the tunnel, in order of preference.")
+	flags.IntVarP(&compressionThreshold, "compression-threshold", "", tunnel.DefaultCompressionThreshold, "Smallest body chunk, in bytes, that gets compressed.")
+}
+
+func addClientFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&server, "server", "s", "http://localhost", "Server connection string")
+	flags.IntVarP(&serverGRPCPort, "grpc-port", "", 8443, "Server GRPC port.")
+	flags.StringVarP(&outboundProxy, "proxy", "", "", "Outbound http, https or socks5 proxy URL, defaults to HTTPS_PROXY or HTTP_PROXY.")
+	flags.StringVarP(&token, "token", "t", "", "Token to use on connect.")
+	flags.StringVarP(&id, "id", "i", "", "id to use for connection")
+	addCompressionFlags(flags)
+	flags.StringVarP(&strategy, "pool", "", "", "Share the id with other clients, load balanced with round-robin, least-in-flight or random.")
+	flags.BoolVarP(&standby, "standby", "", false, "Register as a hot standby that only takes over the id if the active client goes away.")
 }
 
 func initializeConfig(cmd *cobra.Command) error {
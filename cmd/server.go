@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/andrewstucki/light/tunnel"
 	"github.com/spf13/cobra"
@@ -22,7 +23,7 @@ var serverCmd = &cobra.Command{
 
 		port := httpPort
 		if port == 0 {
-			if acmeEmailAddress != "" {
+			if acmeEmailAddress != "" || singlePort {
 				port = 443
 			} else {
 				port = 80
@@ -39,6 +40,25 @@ var serverCmd = &cobra.Command{
 				Token:                serverToken,
 				ACMEEmailAddress:     acmeEmailAddress,
 				CertificateDirectory: certificateCache,
+				TCPPortStart:         tcpPortStart,
+				TCPPortEnd:           tcpPortEnd,
+				UDPPortStart:         udpPortStart,
+				UDPPortEnd:           udpPortEnd,
+				ForwardedHeaders:     forwardedHeaders,
+				TrustedProxies:       trustedProxies,
+				ReconnectGracePeriod: reconnectGracePeriod,
+				DrainTimeout:         drainTimeout,
+				MaxInFlight:          maxInFlight,
+				MaxQueued:            maxQueued,
+				QueueTimeout:         queueTimeout,
+				UpstreamTimeout:      upstreamTimeout,
+				Compression:          compression,
+				CompressionThreshold: compressionThreshold,
+				SinglePort:           singlePort,
+				CACertificate:        caCertificate,
+				CAKey:                caKey,
+				CAOverlap:            caOverlap,
+				CertificateTTL:       certificateTTL,
 			})
 		})
 
@@ -51,14 +71,46 @@ var serverCmd = &cobra.Command{
 	},
 }
 
+var rotateCACmd = &cobra.Command{
+	Use:   "rotate-ca",
+	Short: "Replace the server's CA with a new one.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if caCertificate == "" || caKey == "" {
+			fmt.Fprintln(os.Stderr, "--ca-cert and --ca-key are required")
+			os.Exit(1)
+		}
+		if err := tunnel.RotateCA(caCertificate, caKey, caOverlap); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
 var (
-	host             string
-	address          string
-	acmeEmailAddress string
-	certificateCache string
-	serverToken      string
-	httpPort         int
-	grpcPort         int
+	host                 string
+	address              string
+	acmeEmailAddress     string
+	certificateCache     string
+	serverToken          string
+	httpPort             int
+	grpcPort             int
+	tcpPortStart         int
+	tcpPortEnd           int
+	udpPortStart         int
+	udpPortEnd           int
+	forwardedHeaders     bool
+	trustedProxies       []string
+	reconnectGracePeriod time.Duration
+	drainTimeout         time.Duration
+	maxInFlight          int
+	maxQueued            int
+	queueTimeout         time.Duration
+	upstreamTimeout      time.Duration
+	singlePort           bool
+	caCertificate        string
+	caKey                string
+	caOverlap            time.Duration
+	certificateTTL       time.Duration
 )
 
 func init() {
@@ -67,8 +119,28 @@ func init() {
 	serverCmd.Flags().StringVarP(&acmeEmailAddress, "enable-acme-email", "", "", "ACME email address to use (enables TLS).")
 	serverCmd.Flags().StringVarP(&serverToken, "token", "t", "", "Token to have basic auth on connect.")
 	serverCmd.Flags().StringVarP(&certificateCache, "certificates", "", "", "Certificate caching directory if TLS is enabled.")
-	serverCmd.Flags().IntVarP(&httpPort, "http", "", 0, "HTTP port, defaults to 80 or 443 if TLS is enabled.")
+	serverCmd.Flags().IntVarP(&httpPort, "http", "", 0, "HTTP port, defaults to 80 or 443 if TLS is enabled or serving a single port.")
 	serverCmd.Flags().IntVarP(&grpcPort, "grpc", "", 8443, "GRPC port.")
+	serverCmd.Flags().BoolVarP(&singlePort, "single-port", "", false, "Serve GRPC on the HTTP port alongside public traffic, always over TLS.")
+	serverCmd.Flags().IntVarP(&tcpPortStart, "tcp-port-start", "", 0, "Start of the public port range for TCP tunnels, unset disables TCP tunnels.")
+	serverCmd.Flags().IntVarP(&tcpPortEnd, "tcp-port-end", "", 0, "End of the public port range for TCP tunnels.")
+	serverCmd.Flags().IntVarP(&udpPortStart, "udp-port-start", "", 0, "Start of the public port range for UDP tunnels, unset disables UDP tunnels.")
+	serverCmd.Flags().IntVarP(&udpPortEnd, "udp-port-end", "", 0, "End of the public port range for UDP tunnels.")
+	serverCmd.Flags().BoolVarP(&forwardedHeaders, "forwarded-headers", "", true, "Add X-Forwarded-* and Forwarded headers to tunneled requests.")
+	serverCmd.Flags().StringSliceVarP(&trustedProxies, "trusted-proxies", "", nil, "IPs or CIDRs of proxies in front of the server whose forwarding headers are trusted.")
+	serverCmd.Flags().DurationVarP(&reconnectGracePeriod, "reconnect-grace-period", "", 30*time.Second, "How long a disconnected client's id is held for it to reconnect.")
+	serverCmd.Flags().DurationVarP(&drainTimeout, "drain-timeout", "", 30*time.Second, "How long in-flight requests are waited on when shutting down.")
+	serverCmd.Flags().IntVarP(&maxInFlight, "max-in-flight", "", 128, "Requests each tunnel works on at once, 0 for no limit.")
+	serverCmd.Flags().IntVarP(&maxQueued, "max-queued", "", 256, "Requests each tunnel queues up once it's at its in-flight limit.")
+	serverCmd.Flags().DurationVarP(&queueTimeout, "queue-timeout", "", 10*time.Second, "How long a queued request waits before being turned away.")
+	serverCmd.Flags().DurationVarP(&upstreamTimeout, "upstream-timeout", "", 0, "How long a client has to start responding to a request before the visitor gets a 504, 0 for no limit.")
+	serverCmd.PersistentFlags().StringVarP(&caCertificate, "ca-cert", "", "", "File the CA is kept in, created if missing, unset generates a new CA on every start.")
+	serverCmd.PersistentFlags().StringVarP(&caKey, "ca-key", "", "", "File the CA's private key is kept in.")
+	serverCmd.PersistentFlags().DurationVarP(&caOverlap, "ca-overlap", "", tunnel.DefaultCAOverlap, "How long a rotated out CA stays trusted alongside its replacement.")
+	serverCmd.Flags().DurationVarP(&certificateTTL, "certificate-ttl", "", tunnel.DefaultCertificateTTL, "How long client certificates are good for, connected clients renew theirs before they run out.")
+
+	addCompressionFlags(serverCmd.Flags())
 
+	serverCmd.AddCommand(rotateCACmd)
 	rootCmd.AddCommand(serverCmd)
 }
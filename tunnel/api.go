@@ -1,93 +1,335 @@
 package tunnel
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 
 	"github.com/andrewstucki/light/tunnel/proto"
 )
 
-// apiRequestFromProto
-func apiRequestFromProto(ctx context.Context, req *proto.APIRequest) (*http.Request, error) {
-	body := bytes.NewReader(req.Body)
-	httpReq, err := http.NewRequest(req.RequestMethod, req.RequestUrl, body)
+// apiRequestFromProto rebuilds the request the way the server received it
+func apiRequestFromProto(ctx context.Context, req *proto.APIRequest, body *requestBody) (*http.Request, error) {
+	requestURI := req.RequestUri
+	if requestURI == "" {
+		parameters := make(url.Values)
+		for _, parameter := range req.Parameters {
+			parameters.Add(parameter.Name, parameter.Value)
+		}
+		requestURI = req.RequestUrl
+		if len(parameters) > 0 {
+			requestURI += "?" + parameters.Encode()
+		}
+	}
+	requestURL, err := url.ParseRequestURI(requestURI)
 	if err != nil {
 		return nil, err
 	}
-	httpReq.Header = pairsToHeaders(req.Headers)
-	parameters := httpReq.URL.Query()
-	for _, parameter := range req.Parameters {
-		parameters.Add(parameter.Name, parameter.Value)
+
+	protocol := req.Protocol
+	major, minor, ok := http.ParseHTTPVersion(protocol)
+	if !ok {
+		protocol, major, minor = "HTTP/1.1", 1, 1
+	}
+
+	httpReq := &http.Request{
+		Method:        req.RequestMethod,
+		URL:           requestURL,
+		Proto:         protocol,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        pairsToHeaders(req.Headers),
+		Body:          body,
+		ContentLength: req.ContentLength,
+		Host:          req.Host,
+		RemoteAddr:    req.RemoteAddress,
+		RequestURI:    requestURI,
+		// values get filled in by the body once it's read through
+		Trailer: body.trailer,
+	}
+	if req.ContentLength == 0 {
+		httpReq.Body = http.NoBody
 	}
 
 	return httpReq.WithContext(ctx), nil
 }
 
-// httpRequestToProto
-func httpRequestToProto(req *http.Request) (*proto.APIRequest, error) {
-	defer req.Body.Close()
-	// add 1 byte to easily see if we exceeded the limit
-	reader := io.LimitReader(req.Body, maxRequestSize+1)
-
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(data) > maxRequestSize {
-		return nil, io.EOF
+// httpRequestToProto builds the header frame for a request, the body
+// follows separately as data frames
+func httpRequestToProto(id uint64, req *http.Request) *proto.APIRequest {
+	trailers := []*proto.Pair{}
+	for name := range req.Trailer {
+		trailers = append(trailers, &proto.Pair{
+			Name: name,
+		})
 	}
 	return &proto.APIRequest{
+		Id:            id,
+		Frame:         proto.FrameType_FRAME_HEADER,
 		RequestMethod: req.Method,
 		RequestUrl:    req.URL.Path,
+		RequestUri:    req.RequestURI,
+		Host:          req.Host,
+		RemoteAddress: req.RemoteAddr,
+		Protocol:      req.Proto,
 		Headers:       headersToPairs(req.Header),
 		Parameters:    valuesToPairs(req.URL.Query()),
-		Body:          data,
-	}, nil
+		ContentLength: req.ContentLength,
+		Trailers:      trailers,
+	}
+}
+
+// requestBody is the client side view of a request body that
+// arrives as a series of data frames
+type requestBody struct {
+	ctx     context.Context
+	chunks  chan []byte
+	chunk   []byte
+	trailer http.Header
+	done    chan struct{}
+	// grant, if set, makes room with the server for
+	// more data frames as the reader catches up
+	grant    func(int)
+	consumed credits
+}
+
+var _ io.ReadCloser = &requestBody{}
+
+// newRequestBody
+func newRequestBody(ctx context.Context, trailers []*proto.Pair) *requestBody {
+	var trailer http.Header
+	if len(trailers) > 0 {
+		trailer = make(http.Header)
+		for _, pair := range trailers {
+			trailer[http.CanonicalHeaderKey(pair.Name)] = nil
+		}
+	}
+	return &requestBody{
+		ctx:     ctx,
+		chunks:  make(chan []byte, maxPendingFrames),
+		trailer: trailer,
+		done:    make(chan struct{}),
+	}
+}
+
+// push hands a data frame off to the reader, it drops the data once
+// the handler is finished, with flow control the server never sends
+// more than there's room for, otherwise it blocks while the reader
+// is behind
+func (r *requestBody) push(data []byte) {
+	select {
+	case <-r.ctx.Done():
+	case <-r.done:
+	case r.chunks <- data:
+	}
+}
+
+// end marks the body as complete, filling in any trailers
+// before the reader can see the end of the body
+func (r *requestBody) end(trailers []*proto.Pair) {
+	if r.trailer != nil {
+		for _, pair := range trailers {
+			r.trailer.Add(pair.Name, pair.Value)
+		}
+	}
+	close(r.chunks)
+}
+
+// finish is called once the handler has returned
+func (r *requestBody) finish() {
+	close(r.done)
+}
+
+func (r *requestBody) Read(data []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		select {
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		case chunk, ok := <-r.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.chunk = chunk
+			if n := r.consumed.consume(); n > 0 && r.grant != nil {
+				r.grant(n)
+			}
+		}
+	}
+	n := copy(data, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *requestBody) Close() error {
+	return nil
 }
 
 type apiResponse struct {
-	status  int
-	headers http.Header
-	body    bytes.Buffer
+	id          uint64
+	status      int
+	headers     http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+	hijacked    bool
+	codec       *codec
+	compress    bool
+	send        func(*proto.APIResponse) error
+	splice      func(uint64) (net.Conn, error)
+	err         error
+	// window is the room the server has for our data frames,
+	// waiting on it is bounded by ctx
+	window window
+	ctx    context.Context
+	// started is called once the header goes out
+	started func()
 }
 
-var _ http.ResponseWriter = &apiResponse{}
+var (
+	_ http.ResponseWriter = &apiResponse{}
+	_ http.Hijacker       = &apiResponse{}
+	_ http.Flusher        = &apiResponse{}
+)
 
 // newAPIResponse
-func newAPIResponse() *apiResponse {
+func newAPIResponse(id uint64, codec *codec, send func(*proto.APIResponse) error, splice func(uint64) (net.Conn, error)) *apiResponse {
 	return &apiResponse{
+		id:      id,
 		headers: make(http.Header),
+		codec:   codec,
+		send:    send,
+		splice:  splice,
 	}
 }
 
-// toProto
-func (a *apiResponse) toProto() *proto.APIResponse {
-	if a.body.Len() > maxBodySize {
-		return &proto.APIResponse{
-			Status: int64(http.StatusRequestEntityTooLarge),
-			Body:   []byte("response too large"),
+// sendFrame keeps track of the first failed send, after which
+// nothing else gets written to the stream
+func (a *apiResponse) sendFrame(frame *proto.APIResponse) {
+	if a.err != nil {
+		return
+	}
+	if frame.Frame == proto.FrameType_FRAME_DATA {
+		if a.err = a.window.acquire(a.ctx); a.err != nil {
+			return
 		}
 	}
+	frame.Id = a.id
+	a.err = a.send(frame)
+}
+
+// dataFrame packs the buffered body into a data frame
+func (a *apiResponse) dataFrame() *proto.APIResponse {
+	data, encoding := a.body.Bytes(), ""
+	if a.compress {
+		data, encoding = a.codec.encode(data)
+	}
 	return &proto.APIResponse{
-		Status:  int64(a.status),
-		Body:    a.body.Bytes(),
-		Headers: headersToPairs(a.headers),
+		Frame:    proto.FrameType_FRAME_DATA,
+		Body:     data,
+		Encoding: encoding,
 	}
 }
 
-// convert
-func convert(protoResponse *proto.APIResponse, response http.ResponseWriter) error {
-	headers := response.Header()
-	for _, pair := range protoResponse.Headers {
-		headers.Add(pair.Name, pair.Value)
+// sendData flushes the buffered body out as a data frame
+func (a *apiResponse) sendData() {
+	if a.body.Len() == 0 {
+		return
+	}
+	a.sendFrame(a.dataFrame())
+	a.body.Reset()
+}
+
+// close finishes off the response after the handler returns
+func (a *apiResponse) close() error {
+	if a.hijacked {
+		// the server stopped listening for frames once we spliced
+		return nil
+	}
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	a.sendData()
+	a.sendFrame(&proto.APIResponse{
+		Frame: proto.FrameType_FRAME_END,
+	})
+	return a.err
+}
+
+// errDisconnected is returned for requests that were in flight when
+// the client's stream went away
+var errDisconnected = errors.New("client disconnected")
+
+// convert streams the response frames for a request back to the
+// public client, or splices the connection through to the client
+// if it upgraded, reporting whether the response was started, spliced
+// is called once an upgraded connection no longer counts as in flight,
+// closing timeout gives up on a response that hasn't started yet
+func convert(ctx context.Context, timeout <-chan struct{}, session *requestChannel, pending *pendingRequest, response http.ResponseWriter, spliced func()) (bool, error) {
+	started := false
+	var consumed credits
+	for {
+		select {
+		case <-ctx.Done():
+			return started, io.EOF
+		case <-timeout:
+			return started, context.DeadlineExceeded
+		case <-session.ctx.Done():
+			if len(pending.responses) > 0 {
+				// a draining client hangs up right after sending its
+				// last frames, they still need to make it out
+				continue
+			}
+			return started, io.EOF
+		case <-pending.aborted:
+			if len(pending.responses) > 0 {
+				// frames that made it out before the stream closed still count
+				continue
+			}
+			return started, errDisconnected
+		case splice := <-pending.splices:
+			spliced()
+			return true, hijack(response, splice)
+		case frame := <-pending.responses:
+			switch frame.Frame {
+			case proto.FrameType_FRAME_HEADER:
+				headers := response.Header()
+				for _, pair := range frame.Headers {
+					headers.Add(pair.Name, pair.Value)
+				}
+				response.WriteHeader(int(frame.Status))
+				started = true
+				// the timeout is only for the response to start
+				timeout = nil
+			case proto.FrameType_FRAME_DATA:
+				body, err := decode(frame.Body, frame.Encoding)
+				if err != nil {
+					return started, err
+				}
+				if _, err := response.Write(body); err != nil {
+					return started, err
+				}
+				if frame.Flush {
+					if flusher, ok := response.(http.Flusher); ok {
+						flusher.Flush()
+					}
+				}
+				if n := consumed.consume(); n > 0 && pending.window != nil {
+					// the client can send more now that the visitor took these
+					_ = session.send(ctx, &proto.APIRequest{
+						Id:     pending.id,
+						Frame:  proto.FrameType_FRAME_WINDOW,
+						Window: int32(n),
+					})
+				}
+			case proto.FrameType_FRAME_END:
+				return started, nil
+			}
+		}
 	}
-	response.WriteHeader(int(protoResponse.Status))
-	_, err := response.Write(protoResponse.Body)
-	return err
 }
 
 func (a *apiResponse) Header() http.Header {
@@ -95,11 +337,57 @@ func (a *apiResponse) Header() http.Header {
 }
 
 func (a *apiResponse) Write(data []byte) (int, error) {
-	return a.body.Write(data)
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	written := len(data)
+	for len(data) > 0 {
+		n := bodyChunkSize - a.body.Len()
+		if n > len(data) {
+			n = len(data)
+		}
+		a.body.Write(data[:n])
+		data = data[n:]
+		if a.body.Len() == bodyChunkSize {
+			a.sendData()
+		}
+	}
+	return written, a.err
+}
+
+// Flush sends whatever has been written so far and has the server
+// flush it through to the public client
+func (a *apiResponse) Flush() {
+	if a.hijacked {
+		return
+	}
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	frame := a.dataFrame()
+	frame.Flush = true
+	a.sendFrame(frame)
+	a.body.Reset()
 }
 
 func (a *apiResponse) WriteHeader(statusCode int) {
+	if a.wroteHeader {
+		return
+	}
+	a.wroteHeader = true
 	a.status = statusCode
+	a.compress = a.codec.compresses(a.headers)
+	a.sendFrame(&proto.APIResponse{
+		Frame:   proto.FrameType_FRAME_HEADER,
+		Status:  int64(statusCode),
+		Headers: headersToPairs(a.headers),
+	})
+	if a.started != nil {
+		a.started()
+	}
 }
 
 func headersToPairs(headers http.Header) []*proto.Pair {
@@ -135,3 +423,17 @@ func pairsToHeaders(pairs []*proto.Pair) http.Header {
 	}
 	return headers
 }
+
+// Hijack splices the connection through to the public client, this only
+// works for requests that asked to upgrade their connection
+func (a *apiResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if a.wroteHeader {
+		return nil, nil, errors.New("response already written")
+	}
+	conn, err := a.splice(a.id)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.hijacked = true
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
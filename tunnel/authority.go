@@ -0,0 +1,391 @@
+package tunnel
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// DefaultCAOverlap is how long a CA that was rotated
+	// out stays trusted alongside its replacement
+	DefaultCAOverlap = 24 * time.Hour
+	// DefaultCertificateTTL is how long session certificates are
+	// good for, clients renew them well before they run out
+	DefaultCertificateTTL = time.Hour
+	// caReloadInterval is how often the CA files are
+	// checked for a rotation
+	caReloadInterval = time.Minute
+	// previousSuffix is added to the CA files that RotateCA moves aside
+	previousSuffix = ".previous"
+	// serverSuffix is added to the CA files for the files that the
+	// server's own certificate is kept in
+	serverSuffix = ".server"
+	// serverCertificateTTL is how long the server's own certificate
+	// is good for, it's reissued whenever the CA issuing it changes
+	serverCertificateTTL = 365 * 24 * time.Hour
+)
+
+// authority is the CA that issues session certificates, along with the
+// one that it replaced for as long as the two of them overlap
+type authority struct {
+	certificateFile string
+	keyFile         string
+	overlap         time.Duration
+
+	current  *ca
+	previous *ca
+	// modified is when the CA files last changed on disk
+	modified time.Time
+	// overlapping is set while the previous CA is still trusted
+	overlapping bool
+	server      *tls.Certificate
+	pool        *x509.CertPool
+	bundle      []byte
+
+	mutex sync.RWMutex
+}
+
+// loadAuthority loads the CA kept in the given files, creating it if
+// they don't exist yet, leaving them unset gets a CA that only lasts
+// as long as the process does
+func loadAuthority(certificateFile, keyFile string, overlap time.Duration) (*authority, error) {
+	if (certificateFile == "") != (keyFile == "") {
+		return nil, errors.New("both the CA certificate and key files need to be set")
+	}
+	if overlap == 0 {
+		overlap = DefaultCAOverlap
+	}
+
+	a := &authority{
+		certificateFile: certificateFile,
+		keyFile:         keyFile,
+		overlap:         overlap,
+	}
+	if certificateFile == "" {
+		current, err := generateCA()
+		if err != nil {
+			return nil, err
+		}
+		a.current = current
+		return a, a.rebuild()
+	}
+
+	if _, err := os.Stat(certificateFile); os.IsNotExist(err) {
+		current, err := generateCA()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeCA(current, certificateFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return a, a.load()
+}
+
+// load reads the CA files, along with the previous CA if it's been rotated
+func (a *authority) load() error {
+	info, err := os.Stat(a.certificateFile)
+	if err != nil {
+		return err
+	}
+	current, err := readCA(a.certificateFile, a.keyFile)
+	if err != nil {
+		return err
+	}
+	previous, err := readCA(a.certificateFile+previousSuffix, a.keyFile+previousSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.current = current
+	a.previous = previous
+	a.modified = info.ModTime()
+	a.mutex.Unlock()
+
+	return a.rebuild()
+}
+
+// inOverlap checks whether the previous CA is still trusted, the
+// overlap starts when the current CA's file was written, its
+// certificate is backdated so it can't be gone by
+func (a *authority) inOverlap() bool {
+	if a.previous == nil {
+		return false
+	}
+	now := time.Now()
+	return now.Before(a.modified.Add(a.overlap)) && now.Before(a.previous.Certificate.NotAfter)
+}
+
+// rebuild works out which CAs are trusted and issues the
+// server's own certificate from the right one
+func (a *authority) rebuild() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	overlapping := a.inOverlap()
+	pool := x509.NewCertPool()
+	pool.AddCert(a.current.Certificate)
+	bundle := append([]byte{}, a.current.PEM...)
+	issuer := a.current
+	if overlapping {
+		pool.AddCert(a.previous.Certificate)
+		bundle = append(bundle, a.previous.PEM...)
+		// clients that registered before the rotation only trust
+		// the previous CA, everyone after gets both of them
+		issuer = a.previous
+	}
+
+	server, err := a.loadServerCertificate(issuer)
+	if err != nil {
+		return err
+	}
+
+	a.overlapping = overlapping
+	a.pool = pool
+	a.bundle = bundle
+	a.server = &server
+	return nil
+}
+
+// loadServerCertificate loads the server's certificate kept next to the
+// CA if issuer issued it, otherwise it issues a new one and keeps that
+func (a *authority) loadServerCertificate(issuer *ca) (tls.Certificate, error) {
+	certificateFile, keyFile := a.certificateFile+serverSuffix, a.keyFile+serverSuffix
+	if a.certificateFile != "" {
+		server, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+		if err == nil && issuedBy(server, issuer) {
+			return server, nil
+		}
+	}
+
+	certificate, privateKey, err := issuer.generateServer(sessionServerName, serverCertificateTTL)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	server, err := tls.X509KeyPair(certificate, privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if a.certificateFile == "" {
+		return server, nil
+	}
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return server, os.WriteFile(certificateFile, certificate, 0644)
+}
+
+// issuedBy checks that a server certificate is from issuer, ones that
+// are over halfway through their lifetime get reissued
+func issuedBy(server tls.Certificate, issuer *ca) bool {
+	leaf, err := x509.ParseCertificate(server.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return leaf.CheckSignatureFrom(issuer.Certificate) == nil && time.Until(leaf.NotAfter) > serverCertificateTTL/2
+}
+
+// refresh picks up a rotation, or the end of an overlap
+func (a *authority) refresh() error {
+	if a.certificateFile != "" {
+		info, err := os.Stat(a.certificateFile)
+		if err != nil {
+			return err
+		}
+		a.mutex.RLock()
+		modified := !info.ModTime().Equal(a.modified)
+		a.mutex.RUnlock()
+		if modified {
+			return a.load()
+		}
+	}
+
+	a.mutex.RLock()
+	ended := a.overlapping && !a.inOverlap()
+	a.mutex.RUnlock()
+	if ended {
+		return a.rebuild()
+	}
+	return nil
+}
+
+// run keeps the authority up to date until ctx is cancelled
+func (a *authority) run(ctx context.Context) {
+	ticker := time.NewTicker(caReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// a rotation that's only partly written out fails to
+			// load and gets picked up on the next tick instead
+			_ = a.refresh()
+		}
+	}
+}
+
+// sign issues a session certificate from the current CA
+func (a *authority) sign(host, nonce string, publicKey crypto.PublicKey, ttl time.Duration) ([]byte, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.current.sign(host, nonce, publicKey, ttl)
+}
+
+// trusted returns the PEM encoded CAs that clients should trust
+func (a *authority) trusted() []byte {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.bundle
+}
+
+func (a *authority) serverCertificate() *tls.Certificate {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.server
+}
+
+// verifyClient checks client certificates against whichever CAs are
+// trusted at the time, clients that are registering don't have one
+func (a *authority) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	a.mutex.RLock()
+	pool := a.pool
+	a.mutex.RUnlock()
+
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// credentials are used for the gRPC listener, clients registering
+// don't have a session certificate yet so client certificates are only
+// verified if given, everything but Register checks for one itself
+func (a *authority) credentials(host string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) credentials.TransportCredentials {
+	return credentials.NewTLS(a.tlsConfig(host, getCertificate))
+}
+
+func (a *authority) tlsConfig(host string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// registering clients dial the server's public host name
+			if getCertificate != nil && hello.ServerName == host {
+				return getCertificate(hello)
+			}
+			return a.serverCertificate(), nil
+		},
+		ClientAuth:            tls.RequestClientCert,
+		VerifyPeerCertificate: a.verifyClient,
+	}
+}
+
+// RotateCA replaces the CA kept in the given files with a new one, the
+// old one is moved aside so that servers picking up the change keep
+// trusting it for their overlap window, a CA that was moved aside by
+// the last rotation and is still in that window can't be replaced
+// without cutting off its clients so that's refused
+func RotateCA(certificateFile, keyFile string, overlap time.Duration) error {
+	if overlap == 0 {
+		overlap = DefaultCAOverlap
+	}
+	if _, err := readCA(certificateFile, keyFile); err != nil {
+		return err
+	}
+	info, err := os.Stat(certificateFile)
+	if err != nil {
+		return err
+	}
+	previous, err := readCA(certificateFile+previousSuffix, keyFile+previousSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if previous != nil {
+		ends := info.ModTime().Add(overlap)
+		if previous.Certificate.NotAfter.Before(ends) {
+			ends = previous.Certificate.NotAfter
+		}
+		if time.Now().Before(ends) {
+			return fmt.Errorf("the previous CA is trusted until %s, it can't be rotated out before then", ends.Format(time.RFC3339))
+		}
+	}
+	next, err := generateCA()
+	if err != nil {
+		return err
+	}
+	// write the new CA out first so that the files are only
+	// ever missing for as long as it takes to rename them
+	if err := writeCA(next, certificateFile+".next", keyFile+".next"); err != nil {
+		return err
+	}
+	if err := os.Rename(keyFile, keyFile+previousSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(certificateFile, certificateFile+previousSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(keyFile+".next", keyFile); err != nil {
+		return err
+	}
+	return os.Rename(certificateFile+".next", certificateFile)
+}
+
+func readCA(certificateFile, keyFile string) (*ca, error) {
+	certificatePEM, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseCA(certificatePEM, keyPEM)
+}
+
+func writeCA(c *ca, certificateFile, keyFile string) error {
+	keyPEM, err := c.encodeKey()
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{certificateFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certificateFile, c.PEM, 0644)
+}
@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// caFiles are where a test keeps its CA
+func caFiles(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+}
+
+// age makes the CA files look like they were written a while ago
+func age(t *testing.T, file string, by time.Duration) {
+	t.Helper()
+	then := time.Now().Add(-by)
+	if err := os.Chtimes(file, then, then); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateCARefusedDuringOverlap(t *testing.T) {
+	certificateFile, keyFile := caFiles(t)
+	if _, err := loadAuthority(certificateFile, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := RotateCA(certificateFile, keyFile, time.Hour); err != nil {
+		t.Fatalf("first rotation: %v", err)
+	}
+	rotated, err := os.ReadFile(certificateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RotateCA(certificateFile, keyFile, time.Hour); err == nil {
+		t.Fatal("rotated again while the previous CA was still trusted")
+	}
+	if current, _ := os.ReadFile(certificateFile); string(current) != string(rotated) {
+		t.Fatal("the refused rotation replaced the CA")
+	}
+
+	age(t, certificateFile, 2*time.Hour)
+	if err := RotateCA(certificateFile, keyFile, time.Hour); err != nil {
+		t.Fatalf("rotation after the overlap: %v", err)
+	}
+}
+
+func TestServerCertificateIsKept(t *testing.T) {
+	certificateFile, keyFile := caFiles(t)
+	first, err := loadAuthority(certificateFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadAuthority(certificateFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.serverCertificate().Certificate[0]) != string(second.serverCertificate().Certificate[0]) {
+		t.Fatal("the server certificate was reissued on restart")
+	}
+
+	// it's reissued from the new CA once the old one isn't trusted
+	if err := RotateCA(certificateFile, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	age(t, certificateFile, 2*time.Hour)
+	rotated, err := loadAuthority(certificateFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuedBy(*rotated.serverCertificate(), rotated.current) {
+		t.Fatal("the server certificate wasn't reissued from the new CA")
+	}
+}
+
+// clientCertificate is a session certificate from the authority's current CA
+func clientCertificate(t *testing.T, a *authority) []byte {
+	t.Helper()
+	csr, _, err := generateRequest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := parseRequest(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePEM, err := a.sign("test", "nonce", request.PublicKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseCertificate(t, certificatePEM).Raw
+}
+
+func TestCAOverlap(t *testing.T) {
+	certificateFile, keyFile := caFiles(t)
+	a, err := loadAuthority(certificateFile, keyFile, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := clientCertificate(t, a)
+	old := a.current
+
+	if err := RotateCA(certificateFile, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if a.current == old || !a.overlapping {
+		t.Fatal("the rotation wasn't picked up")
+	}
+	after := clientCertificate(t, a)
+
+	// both CAs are trusted while they overlap, and the server keeps
+	// using a certificate that clients from before the rotation trust
+	if err := a.verifyClient([][]byte{before}, nil); err != nil {
+		t.Fatalf("certificate from the previous CA during the overlap: %v", err)
+	}
+	if err := a.verifyClient([][]byte{after}, nil); err != nil {
+		t.Fatalf("certificate from the current CA during the overlap: %v", err)
+	}
+	if !bytes.Contains(a.trusted(), a.previous.PEM) || !bytes.Contains(a.trusted(), a.current.PEM) {
+		t.Fatal("clients aren't told to trust both CAs")
+	}
+	if !issuedBy(*a.serverCertificate(), a.previous) {
+		t.Fatal("the server certificate isn't from the previous CA")
+	}
+
+	// only the current CA is once the overlap is over
+	time.Sleep(600 * time.Millisecond)
+	if err := a.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if a.overlapping {
+		t.Fatal("the overlap didn't end")
+	}
+	if err := a.verifyClient([][]byte{before}, nil); err == nil {
+		t.Fatal("certificate from the previous CA is still trusted")
+	}
+	if err := a.verifyClient([][]byte{after}, nil); err != nil {
+		t.Fatalf("certificate from the current CA after the overlap: %v", err)
+	}
+	if bytes.Contains(a.trusted(), a.previous.PEM) {
+		t.Fatal("clients are still told to trust the previous CA")
+	}
+	if !issuedBy(*a.serverCertificate(), a.current) {
+		t.Fatal("the server certificate wasn't reissued from the current CA")
+	}
+}
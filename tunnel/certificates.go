@@ -1,58 +1,26 @@
 package tunnel
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net/url"
-	"os"
 	"time"
-
-	"google.golang.org/grpc/credentials"
-)
-
-var (
-	rootCA            *ca
-	serverCredentials credentials.TransportCredentials
 )
 
-func init() {
-	var err error
-	rootCA, err = generateCA()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	certBytes, privateKeyBytes, err := rootCA.generate("server", "")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-	serverCert, err := tls.X509KeyPair(certBytes, privateKeyBytes)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(rootCA.PEM) {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	serverCredentials = credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    certPool,
-	})
-}
+// sessionServerName is the name the server's own certificate is
+// issued for, clients check it when using their session certificates
+const sessionServerName = "server"
 
 func getSVID(host, nonce string) *url.URL {
 	var svid url.URL
@@ -65,35 +33,20 @@ func getSVID(host, nonce string) *url.URL {
 type ca struct {
 	Certificate *x509.Certificate
 	PEM         []byte
-	PrivateKey  *ecdsa.PrivateKey
-	X509        tls.Certificate
+	PrivateKey  crypto.Signer
 }
 
-func (c *ca) generate(host, nonce string) ([]byte, []byte, error) {
+// generateServer issues the server's own certificate for host, it's the
+// only one the CA issues that clients will accept from a server
+func (c *ca) generateServer(host string, ttl time.Duration) ([]byte, []byte, error) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
 	}
-	spiffe := getSVID(host, nonce)
-	serial, err := serialNumber()
-	if err != nil {
-		return nil, nil, err
-	}
-	cert := &x509.Certificate{
-		SerialNumber: serial,
-		DNSNames:     []string{host},
-		URIs:         []*url.URL{spiffe},
-		Subject: pkix.Name{
-			Organization: []string{"Tunnel"},
-		},
-		NotBefore:             time.Now().Add(-2 * time.Minute),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-
-	data, err := x509.CreateCertificate(rand.Reader, cert, c.Certificate, &privateKey.PublicKey, c.PrivateKey)
+	certificatePEM, err := c.issue(&x509.Certificate{
+		DNSNames:    []string{host},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &privateKey.PublicKey, ttl)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -102,10 +55,6 @@ func (c *ca) generate(host, nonce string) ([]byte, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	certificatePEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: data,
-	})
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "EC PRIVATE KEY",
 		Bytes: encoded,
@@ -114,6 +63,94 @@ func (c *ca) generate(host, nonce string) ([]byte, []byte, error) {
 	return certificatePEM, privateKeyPEM, nil
 }
 
+// sign issues a session certificate for someone else's key, identifying
+// it by the SPIFFE ID for the host and nonce, that's good for ttl, it's
+// only good for authenticating clients so that a session can't pass
+// itself off as the server
+func (c *ca) sign(host, nonce string, publicKey crypto.PublicKey, ttl time.Duration) ([]byte, error) {
+	return c.issue(&x509.Certificate{
+		URIs:        []*url.URL{getSVID(host, nonce)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, publicKey, ttl)
+}
+
+// issue fills in everything the CA's certificates have in common
+func (c *ca) issue(cert *x509.Certificate, publicKey crypto.PublicKey, ttl time.Duration) ([]byte, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	cert.SerialNumber = serial
+	cert.Subject = pkix.Name{
+		Organization: []string{"Tunnel"},
+	}
+	cert.NotBefore = time.Now().Add(-2 * time.Minute)
+	cert.NotAfter = time.Now().Add(ttl)
+	cert.KeyUsage = x509.KeyUsageDigitalSignature
+	cert.BasicConstraintsValid = true
+
+	data, err := x509.CreateCertificate(rand.Reader, cert, c.Certificate, publicKey, c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: data,
+	}), nil
+}
+
+// parseRequest checks that a certificate signing request is signed by
+// a key that's strong enough for us to be willing to sign it
+func parseRequest(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("missing certificate signing request")
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	switch key := request.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < 256 {
+			return nil, errors.New("ECDSA keys need to be at least 256 bits")
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys need to be at least 2048 bits")
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", request.PublicKey)
+	}
+	return request, nil
+}
+
+// generateRequest creates a key for a client and a certificate
+// signing request that the server can sign it with
+func generateRequest(id string) ([]byte, *ecdsa.PrivateKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: id,
+		},
+	}, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: data,
+	}), privateKey, nil
+}
+
 func generateCA() (*ca, error) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -139,32 +176,70 @@ func generateCA() (*ca, error) {
 	if err != nil {
 		return nil, err
 	}
+	// parse it back so that whatever we sign gets the
+	// key identifiers filled in when it was created
+	cert, err = x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
 
-	encoded, err := x509.MarshalECPrivateKey(privateKey)
+	return &ca{
+		Certificate: cert,
+		PEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: data,
+		}),
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// parseCA loads a CA from its PEM encoded certificate and key
+func parseCA(certificatePEM, keyPEM []byte) (*ca, error) {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("missing CA certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	certificatePEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: data,
-	})
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: encoded,
-	})
-	x509Cert, err := tls.X509KeyPair(certificatePEM, privateKeyPEM)
+	if !cert.IsCA {
+		return nil, errors.New("certificate isn't a CA")
+	}
+
+	// going through X509KeyPair gets us any kind of key and
+	// makes sure that it's the one the certificate is for
+	pair, err := tls.X509KeyPair(certificatePEM, keyPEM)
 	if err != nil {
 		return nil, err
 	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key")
+	}
 
 	return &ca{
 		Certificate: cert,
-		PEM:         certificatePEM,
-		PrivateKey:  privateKey,
-		X509:        x509Cert,
+		PEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: block.Bytes,
+		}),
+		PrivateKey: signer,
 	}, nil
 }
 
+// encodeKey PEM encodes the CA's key so that it can be persisted
+func (c *ca) encodeKey() ([]byte, error) {
+	encoded, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: encoded,
+	}), nil
+}
+
 func serialNumber() (*big.Int, error) {
 	max := new(big.Int)
 	max.Exp(big.NewInt(2), big.NewInt(80), nil).Sub(max, big.NewInt(1))
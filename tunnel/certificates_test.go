@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func parseCertificate(t *testing.T, certificatePEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		t.Fatal("no certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestSessionCertificatesCantPassAsTheServer(t *testing.T) {
+	authority, err := generateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate)
+	asServer := x509.VerifyOptions{
+		DNSName:   sessionServerName,
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	csr, _, err := generateRequest(sessionServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := parseRequest(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := authority.sign(sessionServerName, "nonce", request.PublicKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseCertificate(t, session).Verify(asServer); err == nil {
+		t.Fatal("a session certificate passed as the server's")
+	}
+
+	server, _, err := authority.generateServer(sessionServerName, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseCertificate(t, server).Verify(asServer); err != nil {
+		t.Fatalf("the server's certificate didn't pass: %v", err)
+	}
+}
+
+func TestRegisterRejectsTheServersName(t *testing.T) {
+	server := newTunnelServer("localhost", "", newTunnelRegistry(0, 0, 0, 0), nil, nil, nil, time.Second, 0)
+	csr, _, err := generateRequest(sessionServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Register(context.Background(), &proto.RegisterRequest{
+		Id:      sessionServerName,
+		Version: protocolVersion,
+		Csr:     csr,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("registering as %q got %v", sessionServerName, err)
+	}
+}
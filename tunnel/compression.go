@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultCompressionThreshold is the smallest chunk of a body that's
+// worth compressing, anything smaller goes out as-is
+const DefaultCompressionThreshold = 1 << 10 // 1 KB
+
+// incompressibleTypes are content types that are already compressed
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMessage))
+	gzipWriters    = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(io.Discard)
+		},
+	}
+)
+
+// negotiateEncoding picks the first of the offered encodings that we
+// also support, an empty string means the link goes uncompressed
+func negotiateEncoding(offered, supported []string) string {
+	for _, encoding := range offered {
+		for _, ours := range supported {
+			if encoding == ours && (encoding == EncodingGzip || encoding == EncodingZstd) {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
+
+// codec compresses the body chunks sent over a tunnel
+type codec struct {
+	encoding  string
+	threshold int
+}
+
+// newCodec returns nil if there's no encoding, which leaves everything uncompressed
+func newCodec(encoding string, threshold int) *codec {
+	if encoding == "" {
+		return nil
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return &codec{
+		encoding:  encoding,
+		threshold: threshold,
+	}
+}
+
+// compresses checks whether a body with the given headers should be compressed
+func (c *codec) compresses(headers http.Header) bool {
+	if c == nil || headers.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		// no content type or one we don't understand, it's worth a shot
+		return true
+	}
+	for _, incompressible := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, incompressible) {
+			return false
+		}
+	}
+	return true
+}
+
+// encode compresses a chunk, it's left alone if it's too small or
+// compressing it doesn't make it any smaller
+func (c *codec) encode(data []byte) ([]byte, string) {
+	if c == nil || len(data) < c.threshold {
+		return data, ""
+	}
+
+	var compressed []byte
+	switch c.encoding {
+	case EncodingZstd:
+		compressed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+	case EncodingGzip:
+		var buffer bytes.Buffer
+		writer := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(&buffer)
+		_, err := writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		gzipWriters.Put(writer)
+		if err != nil {
+			return data, ""
+		}
+		compressed = buffer.Bytes()
+	default:
+		return data, ""
+	}
+	if len(compressed) >= len(data) {
+		return data, ""
+	}
+	return compressed, c.encoding
+}
+
+// decode undoes encode for a chunk that came in over the tunnel
+func decode(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case EncodingZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(io.LimitReader(reader, maxMessage+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxMessage {
+			return nil, errors.New("decompressed chunk is too large")
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
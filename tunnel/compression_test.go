@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"net/http"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("light "), 1<<10)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		compressed, used := newCodec(encoding, 0).encode(data)
+		if used != encoding || len(compressed) >= len(data) {
+			t.Fatalf("%s: encoded %d bytes to %d with %q", encoding, len(data), len(compressed), used)
+		}
+		decoded, err := decode(compressed, used)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: round trip changed the data", encoding)
+		}
+	}
+}
+
+func TestCompressionLeavesChunksAlone(t *testing.T) {
+	random := make([]byte, 4<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		codec *codec
+		data  []byte
+	}{
+		"uncompressed link": {nil, bytes.Repeat([]byte("a"), 4<<10)},
+		"below threshold":   {newCodec(EncodingGzip, 0), bytes.Repeat([]byte("a"), DefaultCompressionThreshold-1)},
+		"incompressible":    {newCodec(EncodingZstd, 0), random},
+	} {
+		encoded, encoding := test.codec.encode(test.data)
+		if encoding != "" || !bytes.Equal(encoded, test.data) {
+			t.Errorf("%s: chunk was encoded with %q", name, encoding)
+		}
+	}
+}
+
+func TestDecompressionIsCapped(t *testing.T) {
+	huge := make([]byte, maxMessage+1)
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(huge)
+	writer.Close()
+	if _, err := decode(buffer.Bytes(), EncodingGzip); err == nil {
+		t.Error("gzip chunk decompressed past the cap")
+	}
+
+	if _, err := decode(zstdEncoder.EncodeAll(huge[:maxMessage], nil), EncodingZstd); err != nil {
+		t.Errorf("zstd chunk right at the cap: %v", err)
+	}
+	if _, err := decode(zstdEncoder.EncodeAll(append(huge, huge...), nil), EncodingZstd); err == nil {
+		t.Error("zstd chunk decompressed past the cap")
+	}
+
+	if _, err := decode([]byte("data"), "br"); err == nil {
+		t.Error("unknown encoding was decoded")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{EncodingGzip, EncodingZstd}
+	for _, test := range []struct {
+		offered  []string
+		expected string
+	}{
+		{[]string{EncodingZstd, EncodingGzip}, EncodingZstd},
+		{[]string{"br", EncodingGzip}, EncodingGzip},
+		{[]string{"br"}, ""},
+		{nil, ""},
+	} {
+		if got := negotiateEncoding(test.offered, supported); got != test.expected {
+			t.Errorf("%v negotiated %q, expected %q", test.offered, got, test.expected)
+		}
+	}
+}
+
+func TestCompressesSkipsCompressedBodies(t *testing.T) {
+	codec := newCodec(EncodingGzip, 0)
+	for _, test := range []struct {
+		headers  http.Header
+		expected bool
+	}{
+		{http.Header{"Content-Type": {"text/html; charset=utf-8"}}, true},
+		{http.Header{}, true},
+		{http.Header{"Content-Type": {"image/png"}}, false},
+		{http.Header{"Content-Type": {"application/zip"}}, false},
+		{http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, false},
+	} {
+		if got := codec.compresses(test.headers); got != test.expected {
+			t.Errorf("%v compresses is %t", test.headers, got)
+		}
+	}
+}
@@ -1,35 +1,186 @@
 package tunnel
 
 import (
-	"bytes"
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/andrewstucki/light/tunnel/proto"
 	"golang.org/x/net/idna"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 //go:generate protoc -Iproto tunnel.proto --go_out=proto/ --go-grpc_out=require_unimplemented_servers=false:proto/
 
+// Protocol is the kind of traffic carried by a tunnel
+type Protocol string
+
+const (
+	ProtocolHTTP Protocol = "http"
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	// ProtocolTLS tunnels are passed through the server without it
+	// terminating TLS, the client terminates it instead
+	ProtocolTLS Protocol = "tls"
+)
+
 type Config struct {
-	Server  string
-	Token   string
-	ID      string
+	Server   string
+	Token    string
+	ID       string
+	Protocol Protocol
+	// GRPCPort is the server's gRPC port, it defaults to 8443
+	GRPCPort int
+	// Transports are tried in order until one of them reaches the
+	// server, by default we dial GRPCPort directly and fall back to
+	// a WebSocket on the server's own port
+	Transports []Transport
+	// Proxy is the outbound proxy that the default transports go
+	// through, either an http or https proxy supporting CONNECT or a
+	// socks5 one, with credentials in the URL's user info if needed,
+	// it defaults to the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	// environment variables
+	Proxy string
+	// Handler serves HTTP and TLS tunnels
 	Handler http.Handler
+	// TLSConfig is used to terminate TLS for passthrough tunnels
+	TLSConfig *tls.Config
+	// Address is the local address dialed for each connection
+	// made to a TCP tunnel or each flow sent to a UDP tunnel
+	Address string
+	// Strategy, if set, lets other clients using the same strategy
+	// join the tunnel and share its traffic
+	Strategy Strategy
+	// Standby registers the client as a hot standby for a tunnel
+	// that it only takes over if the active client goes away
+	Standby bool
+	// Timeout, if set, is how long the server waits on responses to
+	// start before giving up on them, it can't go past the server's own
+	Timeout time.Duration
+	// Compression lists the encodings, gzip and zstd, that we're
+	// willing to compress bodies with in order of preference, the
+	// server picks one that it supports too, bodies smaller than
+	// CompressionThreshold are never compressed
+	Compression          []string
+	CompressionThreshold int
+	// DrainTimeout bounds how long in-flight requests are waited
+	// on once ctx is cancelled, it defaults to 30 seconds
+	DrainTimeout time.Duration
+	// Connected, if set, is called with the public address
+	// of the tunnel once it's been established
+	Connected func(address string)
+}
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	// maxResumeAttempts is how many times we try to pick our old session
+	// back up before assuming the server forgot about it
+	maxResumeAttempts = 3
+	// renewalRetryDelay is how long we wait on a failed
+	// certificate renewal before trying again
+	renewalRetryDelay = 30 * time.Second
+
+	defaultGRPCPort = 8443
+)
+
+// registration is everything we get back from the server when
+// creating a session
+type registration struct {
+	id         string
+	transport  Transport
+	publicPort int
+	codec      *codec
+	features   featureSet
+
+	// credentials change whenever our certificate is renewed,
+	// they're picked up the next time we connect
+	credentials credentials.TransportCredentials
+	renewAt     time.Time
+	expires     time.Time
+	mutex       sync.Mutex
+}
+
+// setCertificate switches over to a newly issued certificate
+func (r *registration) setCertificate(caPEM, certificatePEM []byte, privateKey crypto.Signer) error {
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caPEM) {
+		return errors.New("invalid server CA")
+	}
+
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("invalid session certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	clientCert := tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  privateKey,
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:   sessionServerName,
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.credentials = credentials.NewTLS(tlsConfig)
+	r.expires = leaf.NotAfter
+	// renew two thirds of the way through, which leaves time to retry
+	// if the server can't be reached, NotBefore is backdated so the
+	// lifetime is counted from now instead
+	now := time.Now()
+	r.renewAt = now.Add(leaf.NotAfter.Sub(now) * 2 / 3)
+	return nil
 }
 
-// Connect is used to serve a new client handler
+func (r *registration) transportCredentials() credentials.TransportCredentials {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.credentials
+}
+
+func (r *registration) renewal() time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.renewAt
+}
+
+// expired checks whether our certificate ran out, there's no
+// resuming the session with it after that
+func (r *registration) expired() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return time.Now().After(r.expires)
+}
+
+// Connect is used to serve a new client handler, it reconnects with
+// backoff whenever the connection to the server drops
 func Connect(ctx context.Context, config Config) error {
 	id, err := idna.Lookup.ToASCII(config.ID)
 	if err != nil {
@@ -44,79 +195,245 @@ func Connect(ctx context.Context, config Config) error {
 		return errors.New("must specify an id")
 	}
 
+	if config.Protocol == "" {
+		config.Protocol = ProtocolHTTP
+	}
+
+	if config.Protocol == ProtocolTLS && config.TLSConfig == nil {
+		return errors.New("must specify a TLS configuration for passthrough tunnels")
+	}
+
 	serverURL, err := url.Parse(config.Server)
 	if err != nil {
 		return err
 	}
 
-	serverURL.Path = "/connect"
-	var buffer bytes.Buffer
-	encoder := json.NewEncoder(&buffer)
-	if err := encoder.Encode(&connectRequest{
-		ID: id,
-	}); err != nil {
-		return err
+	grpcPort := config.GRPCPort
+	if grpcPort == 0 {
+		grpcPort = defaultGRPCPort
+	}
+	grpcAddress := serverURL.Hostname() + ":" + strconv.Itoa(grpcPort)
+	transports := config.Transports
+	if len(transports) == 0 {
+		proxyURL, err := proxyFor(config.Proxy, serverURL)
+		if err != nil {
+			return err
+		}
+		dial, err := newDialer(proxyURL)
+		if err != nil {
+			return err
+		}
+		transports = []Transport{
+			&directTransport{address: grpcAddress, dial: dial},
+			newWebsocketTransport(serverURL, dial),
+		}
 	}
 
-	request, err := http.NewRequest("POST", serverURL.String(), &buffer)
+	session, err := register(ctx, serverURL, grpcAddress, transports, id, config)
 	if err != nil {
 		return err
 	}
-	request.Header.Add("Content-Type", "application/json")
-	if config.Token != "" {
-		request.Header.Add("X-Tunnel-Token", config.Token)
+
+	delay := minReconnectDelay
+	failures := 0
+	for {
+		established, err := serve(ctx, grpcAddress, session, config)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if established {
+			delay = minReconnectDelay
+			failures = 0
+		} else {
+			failures++
+		}
+
+		if err == errGoingAway {
+			// the server is shutting down and took our session with it
+			failures = maxResumeAttempts
+		}
+
+		code := status.Code(err)
+		if code == codes.NotFound || code == codes.Unauthenticated || failures >= maxResumeAttempts || session.expired() {
+			// the server doesn't know about our session anymore, or
+			// our certificate ran out before we could renew it
+			renewed, err := register(ctx, serverURL, grpcAddress, transports, id, config)
+			switch status.Code(err) {
+			case codes.OK:
+				session = renewed
+				failures = 0
+			case codes.Unauthenticated:
+				return err
+			}
+			// most likely the server is still holding our id for
+			// our old session, so keep trying to resume it
+		}
+
+		// full jitter on the upper half of the delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
 	}
-	response, err := http.DefaultClient.Do(request)
+}
+
+// register creates a new session on the server over the
+// first of the transports that gets through to it
+func register(ctx context.Context, serverURL *url.URL, grpcAddress string, transports []Transport, id string, config Config) (*registration, error) {
+	// our key never leaves us, the server only gets to sign it
+	csr, privateKey, err := generateRequest(id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var resp *proto.RegisterResponse
+	var transport Transport
+	for _, transport = range transports {
+		resp, err = registerWith(ctx, serverURL, grpcAddress, transport, id, csr, config)
+		if !transportFailed(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if response.StatusCode != http.StatusOK {
-		response.Body.Close()
-		return fmt.Errorf("remote error: %d", response.StatusCode)
+	if _, err := negotiateVersion(int(resp.Version)); err != nil {
+		return nil, fmt.Errorf("incompatible server: %w", err)
 	}
+	features := newFeatureSet(resp.Features)
 
-	resp := &connectResponse{}
-	decoder := json.NewDecoder(response.Body)
-	if err := decoder.Decode(resp); err != nil {
-		response.Body.Close()
-		return err
+	session := &registration{
+		id:         id,
+		transport:  transport,
+		publicPort: int(resp.PublicPort),
+		codec:      newCodec(resp.Compression, config.CompressionThreshold),
+		features:   features,
+	}
+	if err := session.setCertificate(resp.Ca, resp.Certificate, privateKey); err != nil {
+		return nil, err
 	}
-	response.Body.Close()
 
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(resp.CA) {
-		return errors.New("invalid server CA")
+	if config.Connected != nil {
+		address := id + "." + serverURL.Hostname()
+		if resp.PublicPort != 0 {
+			address = serverURL.Hostname() + ":" + strconv.Itoa(int(resp.PublicPort))
+		}
+		config.Connected(address)
 	}
 
-	clientCert, err := tls.X509KeyPair(resp.Certificate, resp.PrivateKey)
+	return session, nil
+}
+
+func registerWith(ctx context.Context, serverURL *url.URL, grpcAddress string, transport Transport, id string, csr []byte, config Config) (*proto.RegisterResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, transportTimeout)
+	defer cancel()
+
+	serverTLSConfig := &tls.Config{
+		ServerName: serverURL.Hostname(),
+	}
+	if serverURL.Scheme != "https" {
+		// a server that isn't using TLS has no public certificate to
+		// check, which leaves us no better off than plain HTTP
+		serverTLSConfig.InsecureSkipVerify = true
+	}
+	connection, err := grpc.DialContext(
+		ctx,
+		grpcAddress,
+		grpc.WithTransportCredentials(credentials.NewTLS(serverTLSConfig)),
+		grpc.WithContextDialer(dialer(transport)),
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer connection.Close()
 
-	tlsConfig := &tls.Config{
-		ServerName:   "server",
-		Certificates: []tls.Certificate{clientCert},
-		RootCAs:      certPool,
+	return proto.NewTunnelClient(connection).Register(ctx, &proto.RegisterRequest{
+		Id:          id,
+		Token:       config.Token,
+		Version:     protocolVersion,
+		Features:    supportedFeatures,
+		Protocol:    string(config.Protocol),
+		Strategy:    string(config.Strategy),
+		Standby:     config.Standby,
+		Timeout:     config.Timeout.Milliseconds(),
+		Compression: config.Compression,
+		Csr:         csr,
+	})
+}
+
+// dialer adapts a transport to gRPC's dialer
+func dialer(transport Transport) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		return transport.Dial(ctx)
 	}
-	tlsCredentials := credentials.NewTLS(tlsConfig)
+}
+
+// serve runs a single connection to the server, reporting whether
+// it got far enough to actually establish the connection
+func serve(ctx context.Context, grpcAddress string, session *registration, config Config) (bool, error) {
+	// the connection outlives ctx for long enough to drain
+	stop := ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	grpcAddress := serverURL.Hostname() + ":" + strconv.Itoa(resp.Port)
 	connection, err := grpc.DialContext(
 		ctx,
 		grpcAddress,
-		grpc.WithTransportCredentials(tlsCredentials),
+		grpc.WithTransportCredentials(session.transportCredentials()),
+		grpc.WithContextDialer(dialer(session.transport)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                heartbeatTimeout * 2,
+			Timeout:             heartbeatTimeout,
+			PermitWithoutStream: true,
+		}),
 	)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer connection.Close()
 
 	client := proto.NewTunnelClient(connection)
+	// heartbeats keep going while we drain, or the server
+	// would give up on us before we're done
 	heartbeat, err := client.Heartbeat(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
+
+	work := newInFlight()
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop.Done():
+		}
+		drainTimeout := config.DrainTimeout
+		if drainTimeout == 0 {
+			drainTimeout = defaultDrainTimeout
+		}
+		drainCtx, cancelDrain := context.WithTimeout(ctx, drainTimeout)
+		defer cancelDrain()
+
+		// stop the server from sending anything new our way
+		// and give whatever's running a chance to finish
+		if session.features.has(featureDrain) {
+			_, _ = client.Drain(drainCtx, &proto.Empty{})
+		}
+		_ = work.drain(drainCtx)
+		if config.Protocol == ProtocolHTTP {
+			// wait on the stream to be closed cleanly so
+			// that our last responses make it out
+			<-drainCtx.Done()
+		}
+		cancel()
+	}()
 	go func() {
 		for {
 			select {
@@ -131,28 +448,200 @@ func Connect(ctx context.Context, config Config) error {
 		}
 	}()
 
+	if session.features.has(featureRenewal) {
+		go renew(ctx, client, session)
+	}
+
+	switch config.Protocol {
+	case ProtocolTCP:
+		return true, serveTCP(ctx, client, config.Address, work)
+	case ProtocolUDP:
+		return true, serveUDP(ctx, client, config.Address)
+	case ProtocolTLS:
+		return true, serveTLS(ctx, client, config.Handler, config.TLSConfig, work)
+	default:
+		return true, serveHTTP(ctx, client, config.Handler, session.codec, session.features, work)
+	}
+}
+
+// renew keeps our certificate from running out for as long as
+// we're connected, so that there's always one to reconnect with
+func renew(ctx context.Context, client proto.TunnelClient, session *registration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(session.renewal())):
+		}
+
+		// a new key for every certificate, just as when registering
+		csr, privateKey, err := generateRequest(session.id)
+		if err == nil {
+			var resp *proto.RenewResponse
+			resp, err = client.Renew(ctx, &proto.RenewRequest{
+				Csr: csr,
+			})
+			if err == nil {
+				err = session.setCertificate(resp.Ca, resp.Certificate, privateKey)
+			}
+		}
+		if err != nil {
+			// keep trying until the certificate runs out, after
+			// that we'll be registering again anyway
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(renewalRetryDelay):
+			}
+		}
+	}
+}
+
+// serveHTTP handles the requests coming in over a ReverseServe stream
+func serveHTTP(ctx context.Context, client proto.TunnelClient, handler http.Handler, codec *codec, features featureSet, work *inFlight) error {
 	option := grpc.MaxCallSendMsgSize(maxMessage)
 	stream, err := client.ReverseServe(ctx, option)
 	if err != nil {
 		return err
 	}
 
+	var sendMutex sync.Mutex
+	send := func(response *proto.APIResponse) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		return stream.Send(response)
+	}
+	splice := func(id uint64) (net.Conn, error) {
+		return openSplice(ctx, client, id, "")
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.drained:
+			sendMutex.Lock()
+			defer sendMutex.Unlock()
+			_ = stream.CloseSend()
+		}
+	}()
+
+	// cancels lets the server stop a request that the visitor gave up
+	// on, windows are the room the server has for each response
+	var cancelMutex sync.Mutex
+	cancels := make(map[uint64]context.CancelFunc)
+	windows := make(map[uint64]window)
+	flowControl := features.has(featureFlowControl)
+	forwarded := features.has(featureForwarded)
+
+	// bodies is only ever touched by the receive loop
+	bodies := make(map[uint64]*requestBody)
+	goingAway := false
 	for {
 		request, err := stream.Recv()
 		if err != nil {
+			if goingAway {
+				return errGoingAway
+			}
 			return err
 		}
 
-		req, err := apiRequestFromProto(ctx, request)
-		if err != nil {
-			return err
-		}
+		switch request.Frame {
+		case proto.FrameType_FRAME_HEADER:
+			requestCtx, cancel := context.WithCancel(ctx)
+			started := func() {}
+			if request.Timeout > 0 {
+				// the server gives up on the request at the same point,
+				// unless we've started responding by then
+				cancel()
+				deadline, cancelDeadline := withStartDeadline(ctx, time.Now().Add(time.Duration(request.Timeout)*time.Millisecond))
+				requestCtx, cancel, started = deadline, cancelDeadline, deadline.start
+			}
+			if forwarded {
+				requestCtx = context.WithValue(requestCtx, forwardedContextKey, true)
+			}
+			var responseWindow window
+			if flowControl {
+				responseWindow = newWindow()
+			}
+			cancelMutex.Lock()
+			cancels[request.Id] = cancel
+			windows[request.Id] = responseWindow
+			cancelMutex.Unlock()
 
-		resp := newAPIResponse()
-		config.Handler.ServeHTTP(resp, req)
+			body := newRequestBody(requestCtx, request.Trailers)
+			if flowControl {
+				id := request.Id
+				body.grant = func(n int) {
+					_ = send(&proto.APIResponse{
+						Id:     id,
+						Frame:  proto.FrameType_FRAME_WINDOW,
+						Window: int32(n),
+					})
+				}
+			}
+			bodies[request.Id] = body
+			done := work.track()
+			// each request gets its own goroutine so that a slow handler
+			// doesn't hold up everything else multiplexed over the stream
+			go func(request *proto.APIRequest) {
+				defer done()
+				serveRequest(requestCtx, handler, request, body, codec, responseWindow, started, send, splice)
 
-		if err := stream.Send(resp.toProto()); err != nil {
-			return err
+				cancelMutex.Lock()
+				delete(cancels, request.Id)
+				delete(windows, request.Id)
+				cancelMutex.Unlock()
+				cancel()
+			}(request)
+		case proto.FrameType_FRAME_DATA:
+			if body, ok := bodies[request.Id]; ok {
+				data, err := decode(request.Body, request.Encoding)
+				if err != nil {
+					return err
+				}
+				body.push(data)
+			}
+		case proto.FrameType_FRAME_END:
+			if body, ok := bodies[request.Id]; ok {
+				body.end(request.Trailers)
+				delete(bodies, request.Id)
+			}
+		case proto.FrameType_FRAME_WINDOW:
+			cancelMutex.Lock()
+			responseWindow := windows[request.Id]
+			cancelMutex.Unlock()
+			responseWindow.grant(int(request.Window))
+		case proto.FrameType_FRAME_CANCEL:
+			cancelMutex.Lock()
+			cancel, ok := cancels[request.Id]
+			cancelMutex.Unlock()
+			if ok {
+				cancel()
+			}
+		case proto.FrameType_FRAME_GOAWAY:
+			// the server hangs up once everything in flight is done
+			goingAway = true
 		}
 	}
 }
+
+func serveRequest(ctx context.Context, handler http.Handler, request *proto.APIRequest, body *requestBody, codec *codec, window window, started func(), send func(*proto.APIResponse) error, splice func(uint64) (net.Conn, error)) {
+	defer body.finish()
+
+	resp := newAPIResponse(request.Id, codec, send, splice)
+	resp.window = window
+	resp.started = started
+	resp.ctx = ctx
+	req, err := apiRequestFromProto(ctx, request, body)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+	} else {
+		handler.ServeHTTP(resp, req)
+	}
+	if ctx.Err() != nil {
+		// the server already gave up on this request
+		return
+	}
+	// a failed send means the stream is gone, which
+	// the receive loop will pick up on its own
+	_ = resp.close()
+}
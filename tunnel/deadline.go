@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// startDeadline is the context for a request that the server gives up
+// on if its response hasn't started by the deadline, handlers see the
+// deadline as usual but it stops applying once the response starts
+type startDeadline struct {
+	context.Context
+	deadline time.Time
+	timer    *time.Timer
+	started  bool
+	expired  bool
+
+	mutex sync.Mutex
+}
+
+func withStartDeadline(parent context.Context, deadline time.Time) (*startDeadline, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	d := &startDeadline{
+		Context:  ctx,
+		deadline: deadline,
+	}
+	d.timer = time.AfterFunc(time.Until(deadline), func() {
+		d.mutex.Lock()
+		// a request that was already cancelled didn't run out of time
+		d.expired = !d.started && ctx.Err() == nil
+		d.mutex.Unlock()
+		if d.expired {
+			cancel()
+		}
+	})
+	return d, func() {
+		d.timer.Stop()
+		cancel()
+	}
+}
+
+// start lifts the deadline, it's called once the response starts
+func (d *startDeadline) start() {
+	d.mutex.Lock()
+	d.started = true
+	d.mutex.Unlock()
+	d.timer.Stop()
+}
+
+func (d *startDeadline) Deadline() (time.Time, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.started {
+		return d.Context.Deadline()
+	}
+	return d.deadline, true
+}
+
+func (d *startDeadline) Err() error {
+	err := d.Context.Err()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err != nil && d.expired {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStartDeadlineExpires(t *testing.T) {
+	deadline := time.Now().Add(50 * time.Millisecond)
+	ctx, cancel := withStartDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if got, ok := ctx.Deadline(); !ok || !got.Equal(deadline) {
+		t.Fatalf("deadline is %v, %t", got, ok)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the deadline never passed")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expired with %v", ctx.Err())
+	}
+}
+
+func TestStartDeadlineLiftedOnceStarted(t *testing.T) {
+	ctx, cancel := withStartDeadline(context.Background(), time.Now().Add(50*time.Millisecond))
+	ctx.start()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("the deadline applied after the response started")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("the deadline is still reported")
+	}
+
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("cancelled with %v", ctx.Err())
+	}
+}
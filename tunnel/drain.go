@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long in-flight work gets
+// to finish up when shutting down
+const defaultDrainTimeout = 30 * time.Second
+
+// errGoingAway is returned once the server has told us that
+// it's shutting down and has hung up on us
+var errGoingAway = errors.New("server is going away")
+
+// inFlight tracks the work a client is in the middle of
+// so that it can finish up before shutting down
+type inFlight struct {
+	count    int
+	idle     chan struct{}
+	draining chan struct{}
+	// drained is closed once draining is over
+	drained chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		draining: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// track marks the start of some work, the returned
+// function needs to be called once it's done
+func (i *inFlight) track() func() {
+	i.mutex.Lock()
+	i.count++
+	i.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			i.mutex.Lock()
+			defer i.mutex.Unlock()
+
+			i.count--
+			if i.count == 0 && i.idle != nil {
+				close(i.idle)
+				i.idle = nil
+			}
+		})
+	}
+}
+
+// drain waits until nothing is left in flight
+func (i *inFlight) drain(ctx context.Context) error {
+	i.once.Do(func() {
+		close(i.draining)
+	})
+	defer func() {
+		select {
+		case <-i.drained:
+		default:
+			close(i.drained)
+		}
+	}()
+	for {
+		i.mutex.Lock()
+		if i.count == 0 {
+			i.mutex.Unlock()
+			return nil
+		}
+		if i.idle == nil {
+			i.idle = make(chan struct{})
+		}
+		idle := i.idle
+		i.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+		}
+	}
+}
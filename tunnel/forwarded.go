@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarded reports whether the server added forwarding headers for the
+// visitor to a tunneled request, anything passing the request along
+// shouldn't add the visitor a second time when it did
+func Forwarded(request *http.Request) bool {
+	forwarded, _ := request.Context().Value(forwardedContextKey).(bool)
+	return forwarded
+}
+
+// forwardedHeaders adds X-Forwarded-* and Forwarded headers to
+// requests at the edge so local apps can see who the visitor was
+type forwardedHeaders struct {
+	trusted []*net.IPNet
+}
+
+// newForwardedHeaders parses trusted proxies given as either CIDRs or bare IPs
+func newForwardedHeaders(trustedProxies []string) (*forwardedHeaders, error) {
+	forwarded := &forwardedHeaders{}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			forwarded.trusted = append(forwarded.trusted, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		forwarded.trusted = append(forwarded.trusted, network)
+	}
+	return forwarded, nil
+}
+
+func (f *forwardedHeaders) isTrusted(ip net.IP) bool {
+	for _, network := range f.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply strips any forwarding headers that didn't come from a trusted
+// proxy and then appends the hop from the immediate peer
+func (f *forwardedHeaders) apply(request *http.Request) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+
+	headers := request.Header
+	if !f.isTrusted(ip) {
+		headers.Del("X-Forwarded-For")
+		headers.Del("X-Forwarded-Proto")
+		headers.Del("X-Forwarded-Host")
+		headers.Del("Forwarded")
+	}
+
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+
+	if prior := headers.Values("X-Forwarded-For"); len(prior) > 0 {
+		headers.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip.String())
+	} else {
+		headers.Set("X-Forwarded-For", ip.String())
+	}
+	// a trusted proxy knows better than we do about these
+	if headers.Get("X-Forwarded-Proto") == "" {
+		headers.Set("X-Forwarded-Proto", scheme)
+	}
+	if headers.Get("X-Forwarded-Host") == "" {
+		headers.Set("X-Forwarded-Host", request.Host)
+	}
+
+	node := ip.String()
+	if ip.To4() == nil {
+		node = "[" + node + "]"
+	}
+	element := fmt.Sprintf("for=%q;host=%q;proto=%s", node, request.Host, scheme)
+	if prior := headers.Values("Forwarded"); len(prior) > 0 {
+		headers.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		headers.Set("Forwarded", element)
+	}
+}
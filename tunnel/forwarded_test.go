@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func forwardedRequest(remoteAddr string, headers map[string]string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "http://test.localhost/", nil)
+	request.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	return request
+}
+
+func TestForwardedHeadersStripSpoofing(t *testing.T) {
+	forwarded, err := newForwardedHeaders([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := forwardedRequest("192.0.2.1:1234", map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         `for="203.0.113.7"`,
+	})
+	forwarded.apply(request)
+
+	for name, expected := range map[string]string{
+		"X-Forwarded-For":   "192.0.2.1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "test.localhost",
+		"Forwarded":         `for="192.0.2.1";host="test.localhost";proto=http`,
+	} {
+		if got := request.Header.Get(name); got != expected {
+			t.Errorf("%s is %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestForwardedHeadersKeepTrustedProxies(t *testing.T) {
+	forwarded, err := newForwardedHeaders([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := forwardedRequest("10.1.2.3:1234", map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         `for="203.0.113.7";proto=https`,
+	})
+	forwarded.apply(request)
+
+	for name, expected := range map[string]string{
+		"X-Forwarded-For":   "203.0.113.7, 10.1.2.3",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         `for="203.0.113.7";proto=https, for="10.1.2.3";host="test.localhost";proto=http`,
+	} {
+		if got := request.Header.Get(name); got != expected {
+			t.Errorf("%s is %q, expected %q", name, got, expected)
+		}
+	}
+
+	// bare IPs are trusted too, and IPv6 nodes get bracketed
+	request = forwardedRequest("[2001:db8::1]:1234", map[string]string{
+		"X-Forwarded-For": "203.0.113.7",
+	})
+	forwarded.apply(request)
+	if got := request.Header.Get("X-Forwarded-For"); got != "203.0.113.7, 2001:db8::1" {
+		t.Errorf("X-Forwarded-For is %q", got)
+	}
+	if got := request.Header.Get("Forwarded"); got != `for="[2001:db8::1]";host="test.localhost";proto=http` {
+		t.Errorf("Forwarded is %q", got)
+	}
+}
+
+func TestForwardedHeadersRejectInvalidProxies(t *testing.T) {
+	for _, proxy := range []string{"not an ip", "10.0.0.0/33"} {
+		if _, err := newForwardedHeaders([]string{proxy}); err == nil {
+			t.Errorf("%q was accepted", proxy)
+		}
+	}
+}
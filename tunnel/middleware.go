@@ -14,9 +14,13 @@ import (
 type contextKey string
 
 const (
-	idContextKey = contextKey("id")
+	idContextKey        = contextKey("id")
+	forwardedContextKey = contextKey("forwarded")
 )
 
+// registerMethod is authenticated with a token rather than a session certificate
+const registerMethod = "/proto.Tunnel/Register"
+
 func id(ctx context.Context) tunnelID {
 	return ctx.Value(idContextKey).(tunnelID)
 }
@@ -44,6 +48,16 @@ func spiffeStreamMiddleware(srv interface{}, ss grpc.ServerStream, info *grpc.St
 	return status.Errorf(codes.Unauthenticated, "unable to authenticate request")
 }
 
+func spiffeUnaryMiddleware(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod == registerMethod {
+		return handler(ctx, req)
+	}
+	if id, ok := verifySPIFFE(ctx); ok {
+		return handler(context.WithValue(ctx, idContextKey, id), req)
+	}
+	return nil, status.Errorf(codes.Unauthenticated, "unable to authenticate request")
+}
+
 func verifySPIFFE(ctx context.Context) (tunnelID, bool) {
 	if p, ok := peer.FromContext(ctx); ok {
 		if mtls, ok := p.AuthInfo.(credentials.TLSInfo); ok {
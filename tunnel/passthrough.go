@@ -0,0 +1,235 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+)
+
+// peekTimeout bounds how long we wait on a ClientHello
+var peekTimeout = 5 * time.Second
+
+var errPeeked = errors.New("peeked client hello")
+
+// readOnlyConn lets a TLS handshake read from a connection
+// without ever writing back to it
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (r *readOnlyConn) Read(data []byte) (int, error) {
+	return r.reader.Read(data)
+}
+
+func (r *readOnlyConn) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekServerName reads the SNI out of a ClientHello, it returns
+// everything that it read so that it can be replayed
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buffer bytes.Buffer
+	var serverName string
+	err := tls.Server(&readOnlyConn{
+		Conn:   conn,
+		reader: io.TeeReader(conn, &buffer),
+	}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if serverName == "" {
+		return "", buffer.Bytes(), err
+	}
+	return serverName, buffer.Bytes(), nil
+}
+
+// sniListener sends connections for passthrough tunnels straight
+// to their clients and hands everything else to the HTTP server
+type sniListener struct {
+	net.Listener
+	route func(serverName string) (*requestChannel, bool)
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newSNIListener(listener net.Listener, route func(serverName string) (*requestChannel, bool)) *sniListener {
+	l := &sniListener{
+		Listener: listener,
+		route:    route,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.accept()
+	return l
+}
+
+func (l *sniListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+func (l *sniListener) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	replayed := &bufferedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+	if err == nil {
+		if session, ok := l.route(serverName); ok {
+			forwardConnection(session, replayed)
+			return
+		}
+	}
+
+	select {
+	case <-l.done:
+		conn.Close()
+	case l.conns <- replayed:
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case err := <-l.errs:
+		return nil, err
+	case conn := <-l.conns:
+		return conn, nil
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// connListener is a net.Listener for connections we get handed
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case <-l.done:
+		conn.Close()
+	case l.conns <- conn:
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case conn := <-l.conns:
+		return conn, nil
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return spliceAddr{}
+}
+
+// serveTLS terminates TLS for every connection the server passes through
+// and serves it with the given handler
+func serveTLS(ctx context.Context, client proto.TunnelClient, handler http.Handler, tlsConfig *tls.Config, work *inFlight) error {
+	stream, err := client.Listen(ctx, &proto.Empty{})
+	if err != nil {
+		return err
+	}
+
+	listener := newConnListener()
+	// requests are tracked by connection as they go active
+	var activeMutex sync.Mutex
+	active := make(map[net.Conn]func())
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig.Clone(),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			activeMutex.Lock()
+			defer activeMutex.Unlock()
+
+			if done, ok := active[conn]; ok {
+				done()
+				delete(active, conn)
+			}
+			if state == http.StateActive {
+				active[conn] = work.track()
+			}
+		},
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.draining:
+			// closes idle connections and any others once
+			// they're done with their current request
+			server.SetKeepAlivesEnabled(false)
+		}
+	}()
+
+	goingAway := false
+	for {
+		connection, err := stream.Recv()
+		if err != nil {
+			if goingAway {
+				return errGoingAway
+			}
+			return err
+		}
+		if connection.GoingAway {
+			goingAway = true
+			continue
+		}
+		go func(connection *proto.Connection) {
+			conn, err := openSplice(ctx, client, connection.Id, connection.RemoteAddress)
+			if err != nil {
+				return
+			}
+			listener.push(conn)
+		}(connection)
+	}
+}
@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategy is how requests are spread over the members
+// of a pooled tunnel
+type Strategy string
+
+const (
+	StrategyRoundRobin    Strategy = "round-robin"
+	StrategyLeastInFlight Strategy = "least-in-flight"
+	StrategyRandom        Strategy = "random"
+)
+
+func (s Strategy) valid() bool {
+	switch s {
+	case "", StrategyRoundRobin, StrategyLeastInFlight, StrategyRandom:
+		return true
+	}
+	return false
+}
+
+// tunnelPool is every client session serving a single tunnel id,
+// tunnels registered without a strategy have a single active member
+// with any others waiting on standby
+type tunnelPool struct {
+	id       string
+	protocol Protocol
+	strategy Strategy
+	members  []*requestChannel
+	next     int
+	// active is the member taking traffic when there's no strategy
+	active   *requestChannel
+	listener io.Closer
+	port     int
+	queue    *requestQueue
+	// timeout is how long requests wait on a response
+	timeout time.Duration
+
+	mutex sync.RWMutex
+}
+
+func newTunnelPool(id string, protocol Protocol, strategy Strategy, queue *requestQueue) *tunnelPool {
+	return &tunnelPool{
+		id:       id,
+		protocol: protocol,
+		strategy: strategy,
+		queue:    queue,
+	}
+}
+
+// accepts checks whether a new client can join the pool
+func (t *tunnelPool) accepts(protocol Protocol, strategy Strategy, standby bool) bool {
+	if t.protocol != protocol {
+		return false
+	}
+	if standby {
+		return t.strategy == "" && strategy == ""
+	}
+	return t.strategy != "" && t.strategy == strategy
+}
+
+func (t *tunnelPool) add(session *requestChannel) {
+	t.mutex.Lock()
+	t.members = append(t.members, session)
+	if t.active == nil {
+		t.active = session
+	}
+	t.mutex.Unlock()
+}
+
+// remove takes a session out of the pool, returning how many are left
+func (t *tunnelPool) remove(session *requestChannel) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, member := range t.members {
+		if member == session {
+			t.members = append(t.members[:i], t.members[i+1:]...)
+			break
+		}
+	}
+	if t.active == session {
+		t.active = nil
+		if len(t.members) > 0 {
+			t.active = t.members[0]
+		}
+	}
+	return len(t.members)
+}
+
+func (t *tunnelPool) close() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+// pick chooses the session to handle the next request, members whose
+// heartbeat lapsed are skipped unless nobody else is around to take it
+func (t *tunnelPool) pick() (*requestChannel, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	healthy := make([]*requestChannel, 0, len(t.members))
+	for _, member := range t.members {
+		if member.healthy() {
+			healthy = append(healthy, member)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		// hold on to requests for a client that's reconnecting
+		for _, member := range t.members {
+			if !member.isDraining() {
+				candidates = append(candidates, member)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	switch t.strategy {
+	case "":
+		// stick with the active member until it goes away, standbys
+		// only ever see traffic once we fail over to them
+		if t.active == nil || (len(healthy) > 0 && !t.active.healthy()) {
+			t.active = candidates[0]
+		}
+		return t.active, true
+	case StrategyLeastInFlight:
+		chosen := candidates[0]
+		least := chosen.inFlight()
+		for _, candidate := range candidates[1:] {
+			if n := candidate.inFlight(); n < least {
+				chosen, least = candidate, n
+			}
+		}
+		return chosen, true
+	case StrategyRandom:
+		return candidates[rand.Intn(len(candidates))], true
+	default:
+		t.next++
+		return candidates[t.next%len(candidates)], true
+	}
+}
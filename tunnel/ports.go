@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var errNoPorts = errors.New("no public ports available")
+
+type portAllocator struct {
+	address string
+	start   int
+	end     int
+	used    map[int]struct{}
+
+	mutex sync.Mutex
+}
+
+func newPortAllocator(address string, start, end int) *portAllocator {
+	if end < start {
+		end = start
+	}
+	return &portAllocator{
+		address: address,
+		start:   start,
+		end:     end,
+		used:    make(map[int]struct{}),
+	}
+}
+
+// bind calls fn with each free address in the range until one succeeds
+func (p *portAllocator) bind(fn func(address string) error) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.start == 0 {
+		return 0, errNoPorts
+	}
+	for port := p.start; port <= p.end; port++ {
+		if _, ok := p.used[port]; ok {
+			continue
+		}
+		if err := fn(p.address + ":" + strconv.Itoa(port)); err != nil {
+			// something else is probably bound to it
+			continue
+		}
+		p.used[port] = struct{}{}
+		return port, nil
+	}
+	return 0, errNoPorts
+}
+
+// listen binds a TCP listener to the first free port in the range, closing
+// the returned listener hands the port back to the allocator
+func (p *portAllocator) listen() (net.Listener, int, error) {
+	var listener net.Listener
+	port, err := p.bind(func(address string) (err error) {
+		listener, err = net.Listen("tcp", address)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &allocatedListener{
+		Listener: listener,
+		release: func() {
+			p.release(port)
+		},
+	}, port, nil
+}
+
+// listenPacket is the UDP equivalent of listen
+func (p *portAllocator) listenPacket() (net.PacketConn, int, error) {
+	var conn net.PacketConn
+	port, err := p.bind(func(address string) (err error) {
+		conn, err = net.ListenPacket("udp", address)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &allocatedPacketConn{
+		PacketConn: conn,
+		release: func() {
+			p.release(port)
+		},
+	}, port, nil
+}
+
+func (p *portAllocator) release(port int) {
+	p.mutex.Lock()
+	delete(p.used, port)
+	p.mutex.Unlock()
+}
+
+type allocatedListener struct {
+	net.Listener
+	release func()
+	once    sync.Once
+}
+
+func (l *allocatedListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(l.release)
+	return err
+}
+
+type allocatedPacketConn struct {
+	net.PacketConn
+	release func()
+	once    sync.Once
+}
+
+func (c *allocatedPacketConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(c.release)
+	return err
+}
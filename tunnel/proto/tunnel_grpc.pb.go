@@ -22,8 +22,16 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TunnelClient interface {
+	// Register is the only call made without a session certificate,
+	// it's authenticated with the server's token instead
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
 	ReverseServe(ctx context.Context, opts ...grpc.CallOption) (Tunnel_ReverseServeClient, error)
 	Heartbeat(ctx context.Context, opts ...grpc.CallOption) (Tunnel_HeartbeatClient, error)
+	Splice(ctx context.Context, opts ...grpc.CallOption) (Tunnel_SpliceClient, error)
+	Listen(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Tunnel_ListenClient, error)
+	Drain(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	// Renew replaces the caller's session certificate before it expires
+	Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*RenewResponse, error)
 }
 
 type tunnelClient struct {
@@ -34,6 +42,15 @@ func NewTunnelClient(cc grpc.ClientConnInterface) TunnelClient {
 	return &tunnelClient{cc}
 }
 
+func (c *tunnelClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/proto.Tunnel/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *tunnelClient) ReverseServe(ctx context.Context, opts ...grpc.CallOption) (Tunnel_ReverseServeClient, error) {
 	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[0], "/proto.Tunnel/ReverseServe", opts...)
 	if err != nil {
@@ -99,24 +116,128 @@ func (x *tunnelHeartbeatClient) CloseAndRecv() (*Empty, error) {
 	return m, nil
 }
 
+func (c *tunnelClient) Splice(ctx context.Context, opts ...grpc.CallOption) (Tunnel_SpliceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[2], "/proto.Tunnel/Splice", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tunnelSpliceClient{stream}
+	return x, nil
+}
+
+type Tunnel_SpliceClient interface {
+	Send(*Chunk) error
+	Recv() (*Chunk, error)
+	grpc.ClientStream
+}
+
+type tunnelSpliceClient struct {
+	grpc.ClientStream
+}
+
+func (x *tunnelSpliceClient) Send(m *Chunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *tunnelSpliceClient) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tunnelClient) Listen(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Tunnel_ListenClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[3], "/proto.Tunnel/Listen", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tunnelListenClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Tunnel_ListenClient interface {
+	Recv() (*Connection, error)
+	grpc.ClientStream
+}
+
+type tunnelListenClient struct {
+	grpc.ClientStream
+}
+
+func (x *tunnelListenClient) Recv() (*Connection, error) {
+	m := new(Connection)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tunnelClient) Drain(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Tunnel/Drain", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tunnelClient) Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*RenewResponse, error) {
+	out := new(RenewResponse)
+	err := c.cc.Invoke(ctx, "/proto.Tunnel/Renew", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TunnelServer is the server API for Tunnel service.
 // All implementations should embed UnimplementedTunnelServer
 // for forward compatibility
 type TunnelServer interface {
+	// Register is the only call made without a session certificate,
+	// it's authenticated with the server's token instead
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
 	ReverseServe(Tunnel_ReverseServeServer) error
 	Heartbeat(Tunnel_HeartbeatServer) error
+	Splice(Tunnel_SpliceServer) error
+	Listen(*Empty, Tunnel_ListenServer) error
+	Drain(context.Context, *Empty) (*Empty, error)
+	// Renew replaces the caller's session certificate before it expires
+	Renew(context.Context, *RenewRequest) (*RenewResponse, error)
 }
 
 // UnimplementedTunnelServer should be embedded to have forward compatible implementations.
 type UnimplementedTunnelServer struct {
 }
 
+func (UnimplementedTunnelServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
 func (UnimplementedTunnelServer) ReverseServe(Tunnel_ReverseServeServer) error {
 	return status.Errorf(codes.Unimplemented, "method ReverseServe not implemented")
 }
 func (UnimplementedTunnelServer) Heartbeat(Tunnel_HeartbeatServer) error {
 	return status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
 }
+func (UnimplementedTunnelServer) Splice(Tunnel_SpliceServer) error {
+	return status.Errorf(codes.Unimplemented, "method Splice not implemented")
+}
+func (UnimplementedTunnelServer) Listen(*Empty, Tunnel_ListenServer) error {
+	return status.Errorf(codes.Unimplemented, "method Listen not implemented")
+}
+func (UnimplementedTunnelServer) Drain(context.Context, *Empty) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Drain not implemented")
+}
+func (UnimplementedTunnelServer) Renew(context.Context, *RenewRequest) (*RenewResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Renew not implemented")
+}
 
 // UnsafeTunnelServer may be embedded to opt out of forward compatibility for this service.
 // Use of this interface is not recommended, as added methods to TunnelServer will
@@ -129,6 +250,24 @@ func RegisterTunnelServer(s grpc.ServiceRegistrar, srv TunnelServer) {
 	s.RegisterService(&Tunnel_ServiceDesc, srv)
 }
 
+func _Tunnel_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TunnelServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Tunnel/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TunnelServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Tunnel_ReverseServe_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(TunnelServer).ReverseServe(&tunnelReverseServeServer{stream})
 }
@@ -181,13 +320,109 @@ func (x *tunnelHeartbeatServer) Recv() (*Empty, error) {
 	return m, nil
 }
 
+func _Tunnel_Splice_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TunnelServer).Splice(&tunnelSpliceServer{stream})
+}
+
+type Tunnel_SpliceServer interface {
+	Send(*Chunk) error
+	Recv() (*Chunk, error)
+	grpc.ServerStream
+}
+
+type tunnelSpliceServer struct {
+	grpc.ServerStream
+}
+
+func (x *tunnelSpliceServer) Send(m *Chunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *tunnelSpliceServer) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Tunnel_Listen_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TunnelServer).Listen(m, &tunnelListenServer{stream})
+}
+
+type Tunnel_ListenServer interface {
+	Send(*Connection) error
+	grpc.ServerStream
+}
+
+type tunnelListenServer struct {
+	grpc.ServerStream
+}
+
+func (x *tunnelListenServer) Send(m *Connection) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Tunnel_Drain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TunnelServer).Drain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Tunnel/Drain",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TunnelServer).Drain(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tunnel_Renew_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TunnelServer).Renew(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Tunnel/Renew",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TunnelServer).Renew(ctx, req.(*RenewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Tunnel_ServiceDesc is the grpc.ServiceDesc for Tunnel service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var Tunnel_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "proto.Tunnel",
 	HandlerType: (*TunnelServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Tunnel_Register_Handler,
+		},
+		{
+			MethodName: "Drain",
+			Handler:    _Tunnel_Drain_Handler,
+		},
+		{
+			MethodName: "Renew",
+			Handler:    _Tunnel_Renew_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ReverseServe",
@@ -200,6 +435,17 @@ var Tunnel_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Tunnel_Heartbeat_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Splice",
+			Handler:       _Tunnel_Splice_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Listen",
+			Handler:       _Tunnel_Listen_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "tunnel.proto",
 }
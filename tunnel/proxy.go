@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc opens a connection to the given address
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// proxyFor picks the outbound proxy used to reach the server, either the
+// configured one or whatever the environment says to use for serverURL
+func proxyFor(configured string, serverURL *url.URL) (*url.URL, error) {
+	if configured == "" {
+		return httpproxy.FromEnvironment().ProxyFunc()(serverURL)
+	}
+	proxyURL, err := url.Parse(configured)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	return proxyURL, nil
+}
+
+// newDialer returns a dialer going through the proxy at proxyURL, a
+// nil proxyURL dials directly
+func newDialer(proxyURL *url.URL) (dialFunc, error) {
+	var direct net.Dialer
+	if proxyURL == nil {
+		return direct.DialContext, nil
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return (&connectDialer{
+			proxy: proxyURL,
+			dial:  direct.DialContext,
+		}).DialContext, nil
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported proxy %q", proxyURL.Redacted())
+		}
+		return contextDialer.DialContext, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+// connectDialer tunnels connections through an HTTP proxy with CONNECT
+type connectDialer struct {
+	proxy *url.URL
+	dial  dialFunc
+}
+
+func (c *connectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyAddress := c.proxy.Host
+	if c.proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(c.proxy.Hostname(), "80")
+		if c.proxy.Scheme == "https" {
+			proxyAddress = net.JoinHostPort(c.proxy.Hostname(), "443")
+		}
+	}
+	conn, err := c.dial(ctx, network, proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if c.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: c.proxy.Hostname(),
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader, err := c.connect(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() > 0 {
+		// whatever came in behind the proxy's response belongs to the server
+		return &bufferedConn{
+			Conn:   conn,
+			reader: io.MultiReader(reader, conn),
+		}, nil
+	}
+	return conn, nil
+}
+
+func (c *connectDialer) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if c.proxy.User != nil {
+		password, _ := c.proxy.User.Password()
+		credentials := c.proxy.User.Username() + ":" + password
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", address, response.Status)
+	}
+	// past this point the body is the connection itself, so it's
+	// left alone rather than read to the end by closing it
+	return reader, nil
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeProxy answers a single CONNECT with reply and then echoes whatever
+// comes through, it hands back the request it got
+func fakeProxy(t *testing.T, reply string) (*url.URL, chan *http.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- request
+		// the reply and the first bytes from the server arrive together
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}, requests
+}
+
+func TestConnectDialer(t *testing.T) {
+	proxyURL, requests := fakeProxy(t, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	proxyURL.User = url.UserPassword("user", "pass")
+	dial, err := newDialer(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", "server.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "server.example:443" {
+		t.Fatalf("proxy got %s %s", request.Method, request.Host)
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if got := request.Header.Get("Proxy-Authorization"); got != expected {
+		t.Fatalf("Proxy-Authorization is %q", got)
+	}
+
+	// what came in behind the proxy's reply isn't lost
+	buffered := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, buffered); err != nil || string(buffered) != "hello" {
+		t.Fatalf("read %q, %v", buffered, err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len("ping"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("read %q, %v", echoed, err)
+	}
+}
+
+func TestConnectDialerRefused(t *testing.T) {
+	proxyURL, _ := fakeProxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	dial, err := newDialer(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if conn, err := dial(ctx, "tcp", "server.example:443"); err == nil {
+		conn.Close()
+		t.Fatal("dialed through a proxy that refused")
+	}
+}
+
+func TestNewDialerRejectsUnknownSchemes(t *testing.T) {
+	if _, err := newDialer(&url.URL{Scheme: "ftp", Host: "proxy.example:21"}); err == nil {
+		t.Fatal("ftp proxy was accepted")
+	}
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("request queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+// requestQueue bounds how many requests a tunnel works on at once
+// and how many more are allowed to wait for their turn
+type requestQueue struct {
+	slots     chan struct{}
+	queued    int
+	maxQueued int
+	timeout   time.Duration
+
+	mutex sync.Mutex
+}
+
+// newRequestQueue returns a queue allowing maxInFlight requests at
+// once, leaving maxInFlight at zero doesn't put any bounds on it
+func newRequestQueue(maxInFlight, maxQueued int, timeout time.Duration) *requestQueue {
+	queue := &requestQueue{
+		maxQueued: maxQueued,
+		timeout:   timeout,
+	}
+	if maxInFlight > 0 {
+		queue.slots = make(chan struct{}, maxInFlight)
+	}
+	return queue
+}
+
+// acquire waits for an in-flight slot, the returned function hands
+// it back once the request is done and can be called more than once
+func (q *requestQueue) acquire(ctx context.Context) (func(), error) {
+	if q.slots == nil {
+		return func() {}, nil
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-q.slots
+		})
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.mutex.Lock()
+	if q.queued >= q.maxQueued {
+		q.mutex.Unlock()
+		return nil, errQueueFull
+	}
+	q.queued++
+	q.mutex.Unlock()
+	defer func() {
+		q.mutex.Lock()
+		q.queued--
+		q.mutex.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, errQueueTimeout
+	case q.slots <- struct{}{}:
+		return release, nil
+	}
+}
+
+// retryAfter is a guess, in seconds, at when a
+// rejected request is worth trying again
+func (q *requestQueue) retryAfter() int {
+	seconds := int((q.timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"io"
+	"net/http"
 	"sync"
 	"time"
 
@@ -11,24 +12,66 @@ import (
 
 var heartbeatTimeout = 5 * time.Second
 
-type requestChannel struct {
-	ctx       context.Context
-	heartbeat time.Time
-	requests  chan (*proto.APIRequest)
+// maxPendingFrames bounds how many data frames are buffered for a
+// single request, with flow control the sender waits for room rather
+// than the receiver blocking the stream on a request that's behind
+const maxPendingFrames = 16
+
+// cancelTimeout bounds how long letting a client know that a request
+// was given up on waits for a stream to send it over
+const cancelTimeout = 5 * time.Second
+
+type pendingRequest struct {
+	id      uint64
+	upgrade bool
+	// window is the room the client has for the request's body
+	window window
+	// stream is the stream the request went out on, zero until it's sent
+	stream    uint64
 	responses chan (*proto.APIResponse)
+	splices   chan (*splice)
+	done      chan struct{}
+	aborted   chan struct{}
+}
+
+type requestChannel struct {
+	ctx         context.Context
+	protocol    Protocol
+	codec       *codec
+	features    featureSet
+	heartbeat   time.Time
+	requests    chan (*proto.APIRequest)
+	connections chan (*proto.Connection)
+	pending     map[uint64]*pendingRequest
+	nextID      uint64
+	// attached is how many streams the client has open to us
+	attached int
+	// streams numbers every stream the client has ever opened
+	streams uint64
+	// replaced is closed once the stream the client has
+	// open now is replaced by one it reconnected with
+	replaced chan struct{}
+	// beating is how many Heartbeat streams the client has open, an
+	// old one can still be closing after the client has reconnected
+	beating int
+	// draining sessions don't get any new work
+	draining bool
 
 	mutex  sync.RWMutex
 	cancel func()
 }
 
-func newRequestChannel() *requestChannel {
+func newRequestChannel(protocol Protocol, codec *codec) *requestChannel {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &requestChannel{
-		ctx:       ctx,
-		heartbeat: time.Now(),
-		requests:  make(chan *proto.APIRequest),
-		responses: make(chan *proto.APIResponse),
-		cancel:    cancel,
+		ctx:         ctx,
+		protocol:    protocol,
+		codec:       codec,
+		heartbeat:   time.Now(),
+		requests:    make(chan *proto.APIRequest),
+		connections: make(chan *proto.Connection),
+		pending:     make(map[uint64]*pendingRequest),
+		cancel:      cancel,
 	}
 }
 
@@ -36,39 +79,323 @@ func (r *requestChannel) close() {
 	r.cancel()
 }
 
-func (r *requestChannel) send(ctx context.Context, request *proto.APIRequest) (*proto.APIResponse, error) {
+// healthy is whether the client is both connected and heartbeating
+func (r *requestChannel) healthy() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.attached > 0 && r.beating > 0 && !r.draining && time.Since(r.heartbeat) < heartbeatTimeout*2
+}
+
+func (r *requestChannel) isDraining() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.draining
+}
+
+// drain stops new work from being routed to the session, the
+// work that's already in flight is left to finish up
+func (r *requestChannel) drain() {
+	r.mutex.Lock()
+	r.draining = true
+	r.mutex.Unlock()
+}
+
+// goAway lets the client know that the server is about to hang
+// up on it so that it can go and reconnect
+func (r *requestChannel) goAway() {
+	if !r.features.has(featureDrain) {
+		// older clients find out when we hang up
+		return
+	}
+	switch r.protocol {
+	case ProtocolHTTP:
+		_ = r.send(r.ctx, &proto.APIRequest{
+			Frame: proto.FrameType_FRAME_GOAWAY,
+		})
+	default:
+		_ = r.connect(r.ctx, &proto.Connection{
+			GoingAway: true,
+		})
+	}
+}
+
+func (r *requestChannel) inFlight() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.pending)
+}
+
+func (r *requestChannel) attach() func() {
+	r.mutex.Lock()
+	r.attached++
+	r.mutex.Unlock()
+	return func() {
+		r.mutex.Lock()
+		r.attached--
+		r.mutex.Unlock()
+	}
+}
+
+func (r *requestChannel) beat() func() {
+	r.mutex.Lock()
+	r.beating++
+	r.mutex.Unlock()
+	return func() {
+		r.mutex.Lock()
+		r.beating--
+		r.mutex.Unlock()
+	}
+}
+
+func (r *requestChannel) open(upgrade bool) *pendingRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextID++
+	pending := &pendingRequest{
+		id:      r.nextID,
+		upgrade: upgrade,
+		// the header and end frames don't count against the window
+		responses: make(chan *proto.APIResponse, maxPendingFrames+2),
+		splices:   make(chan *splice, 1),
+		done:      make(chan struct{}),
+		aborted:   make(chan struct{}),
+	}
+	if r.features.has(featureFlowControl) {
+		pending.window = newWindow()
+	}
+	r.pending[pending.id] = pending
+	return pending
+}
+
+// sending records which stream a request is going out on
+func (r *requestChannel) sending(request *proto.APIRequest, stream uint64) {
+	if request.Frame != proto.FrameType_FRAME_HEADER {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if pending, ok := r.pending[request.Id]; ok {
+		pending.stream = stream
+	}
+}
+
+// abort fails everything that went out on the given stream, their
+// responses went down with it, requests on any other stream the
+// client has reconnected with are left alone
+func (r *requestChannel) abort(stream uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for id, pending := range r.pending {
+		if pending.stream != stream {
+			continue
+		}
+		delete(r.pending, id)
+		close(pending.aborted)
+	}
+}
+
+func (r *requestChannel) finish(pending *pendingRequest) {
+	r.mutex.Lock()
+	delete(r.pending, pending.id)
+	r.mutex.Unlock()
+	close(pending.done)
+}
+
+func (r *requestChannel) resolve(response *proto.APIResponse) {
+	r.mutex.RLock()
+	pending, ok := r.pending[response.Id]
+	r.mutex.RUnlock()
+	if !ok {
+		// the requester already gave up
+		return
+	}
+	if response.Frame == proto.FrameType_FRAME_WINDOW {
+		pending.window.grant(int(response.Window))
+		return
+	}
+	// with flow control there's always room, older clients can
+	// still hold up the stream when a visitor falls behind
+	select {
+	case <-r.ctx.Done():
+	case <-pending.done:
+	case pending.responses <- response:
+	}
+}
+
+func (r *requestChannel) send(ctx context.Context, request *proto.APIRequest) error {
 	select {
 	case <-ctx.Done():
-		return nil, io.EOF
+		return io.EOF
 	case <-r.ctx.Done():
-		return nil, io.EOF
+		return io.EOF
 	case r.requests <- request:
+		return nil
+	}
+}
+
+// splice hands a Splice stream off to an upgrade request, the returned
+// channel is closed once the request is done with the stream
+func (r *requestChannel) splice(id uint64, stream chunkStream) (chan struct{}, bool) {
+	r.mutex.RLock()
+	pending, ok := r.pending[id]
+	r.mutex.RUnlock()
+	if !ok || !pending.upgrade {
+		return nil, false
+	}
+
+	s := &splice{
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+	select {
+	case <-r.ctx.Done():
+		return nil, false
+	case <-pending.done:
+		return nil, false
+	case pending.splices <- s:
+		return s.done, true
+	}
+}
+
+// cancelRequest tells the client to stop handling a request
+func (r *requestChannel) cancelRequest(id uint64) error {
+	ctx, cancel := context.WithTimeout(r.ctx, cancelTimeout)
+	defer cancel()
+
+	return r.send(ctx, &proto.APIRequest{
+		Id:    id,
+		Frame: proto.FrameType_FRAME_CANCEL,
+	})
+}
+
+// sendBody streams the body out as data frames, always terminating
+// it with an end frame so the client never waits on a dead request,
+// trailers are only available once the body has been read through
+func (r *requestChannel) sendBody(ctx context.Context, pending *pendingRequest, body io.Reader, trailer http.Header, compress bool) error {
+	id := pending.id
+	buffer := make([]byte, bodyChunkSize)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			data, encoding := append([]byte(nil), buffer[:n]...), ""
+			if compress {
+				data, encoding = r.codec.encode(data)
+			}
+			// wait on the client to make room for the frame first
+			sendErr := pending.window.acquire(ctx)
+			if sendErr == nil {
+				sendErr = r.send(ctx, &proto.APIRequest{
+					Id:       id,
+					Frame:    proto.FrameType_FRAME_DATA,
+					Body:     data,
+					Encoding: encoding,
+				})
+			}
+			if sendErr != nil {
+				err = sendErr
+			}
+		}
+		if err != nil {
+			end := &proto.APIRequest{
+				Id:    id,
+				Frame: proto.FrameType_FRAME_END,
+			}
+			if err == io.EOF {
+				end.Trailers = headersToPairs(trailer)
+			}
+			endErr := r.send(r.ctx, end)
+			if err == io.EOF {
+				return endErr
+			}
+			return err
+		}
+	}
+}
+
+// connect announces a new public connection to the client, which
+// is expected to pick it up with a Splice stream
+func (r *requestChannel) connect(ctx context.Context, connection *proto.Connection) error {
+	select {
+	case <-ctx.Done():
+		return io.EOF
+	case <-r.ctx.Done():
+		return io.EOF
+	case r.connections <- connection:
+		return nil
+	}
+}
+
+// takeOver numbers a new stream from the client and makes it the
+// one that work goes out on, a client only keeps one stream open so
+// any older one is on a connection that died without us noticing
+func (r *requestChannel) takeOver() (uint64, chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.replaced != nil {
+		close(r.replaced)
+	}
+	r.replaced = make(chan struct{})
+	r.streams++
+	return r.streams, r.replaced
+}
+
+func (r *requestChannel) accept(ctx context.Context, send func(*proto.Connection) error) error {
+	_, replaced := r.takeOver()
+	defer r.attach()()
+
+	for {
 		select {
 		case <-ctx.Done():
-			return nil, io.EOF
+			return io.EOF
 		case <-r.ctx.Done():
-			return nil, io.EOF
-		case response := <-r.responses:
-			return response, nil
+			return io.EOF
+		case <-replaced:
+			return io.EOF
+		case connection := <-r.connections:
+			if err := send(connection); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (r *requestChannel) handle(fn func(*proto.APIRequest) (*proto.APIResponse, error)) error {
+func (r *requestChannel) handle(send func(*proto.APIRequest) error, recv func() (*proto.APIResponse, error)) error {
+	stream, replaced := r.takeOver()
+	defer r.abort(stream)
+	defer r.attach()()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			response, err := recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			r.resolve(response)
+		}
+	}()
+
 	for {
 		select {
 		case <-r.ctx.Done():
 			return io.EOF
+		case <-replaced:
+			return io.EOF
+		case err := <-errs:
+			return err
 		case request := <-r.requests:
-			response, err := fn(request)
-			if err != nil {
+			r.sending(request, stream)
+			if err := send(request); err != nil {
 				return err
 			}
-			select {
-			case <-r.ctx.Done():
-				return io.EOF
-			case r.responses <- response:
-			}
 		}
 	}
 }
@@ -78,55 +405,95 @@ type tunnelID struct {
 	nonce string
 }
 
+// sessionOptions are everything a client asked for when registering
+type sessionOptions struct {
+	protocol Protocol
+	strategy Strategy
+	standby  bool
+	timeout  time.Duration
+	codec    *codec
+	features featureSet
+}
+
 type tunnelRegistry struct {
-	ids      map[string]tunnelID
+	tunnels  map[string]*tunnelPool
 	sessions map[tunnelID]*requestChannel
+	// gracePeriod is how long a session's id is held after its
+	// client goes away, only that client can pick it back up
+	gracePeriod time.Duration
+	// every tunnel gets its own queue with these bounds
+	maxInFlight  int
+	maxQueued    int
+	queueTimeout time.Duration
 
 	mutex sync.RWMutex
 }
 
-func newTunnelRegistry() *tunnelRegistry {
+func newTunnelRegistry(gracePeriod time.Duration, maxInFlight, maxQueued int, queueTimeout time.Duration) *tunnelRegistry {
 	return &tunnelRegistry{
-		ids:      make(map[string]tunnelID),
-		sessions: make(map[tunnelID]*requestChannel),
+		tunnels:      make(map[string]*tunnelPool),
+		sessions:     make(map[tunnelID]*requestChannel),
+		gracePeriod:  gracePeriod,
+		maxInFlight:  maxInFlight,
+		maxQueued:    maxQueued,
+		queueTimeout: queueTimeout,
 	}
 }
 
-func (r *tunnelRegistry) createSession(id string) (string, bool, error) {
+// createSession adds a session for the id, either starting a new tunnel or
+// joining an existing one as a pool member or standby, listen is only
+// called for brand new tunnels
+func (r *tunnelRegistry) createSession(id string, options sessionOptions, listen func(tunnel *tunnelPool) (io.Closer, int, error)) (string, int, bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if tunnelID, ok := r.ids[id]; ok {
-		if _, ok := r.sessions[tunnelID]; ok {
-			return "", false, nil
-		}
+	tunnel, ok := r.tunnels[id]
+	if ok && !tunnel.accepts(options.protocol, options.strategy, options.standby) {
+		return "", 0, false, nil
 	}
 	serial, err := serialNumber()
 	if err != nil {
-		return "", false, err
+		return "", 0, false, err
 	}
 	nonce := serial.Text(32)
-	tunnelID := tunnelID{
+	if !ok {
+		tunnel = newTunnelPool(id, options.protocol, options.strategy, newRequestQueue(r.maxInFlight, r.maxQueued, r.queueTimeout))
+		tunnel.timeout = options.timeout
+		if listen != nil {
+			tunnel.listener, tunnel.port, err = listen(tunnel)
+			if err != nil {
+				return "", 0, false, err
+			}
+		}
+		r.tunnels[id] = tunnel
+	}
+	session := newRequestChannel(options.protocol, options.codec)
+	session.features = options.features
+	tunnel.add(session)
+	r.sessions[tunnelID{
 		id:    id,
 		nonce: nonce,
-	}
-	r.ids[id] = tunnelID
-	r.sessions[tunnelID] = newRequestChannel()
-	return nonce, true, nil
+	}] = session
+	return nonce, tunnel.port, true, nil
 }
 
 func (r *tunnelRegistry) sessionByID(id string) (*requestChannel, bool) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	if tunnelID, ok := r.ids[id]; ok {
-		if session, ok := r.sessions[tunnelID]; ok {
-			return session, true
-		}
+	if tunnel, ok := r.tunnels[id]; ok {
+		return tunnel.pick()
 	}
 	return nil, false
 }
 
+func (r *tunnelRegistry) tunnel(id string) (*tunnelPool, bool) {
+	r.mutex.RLock()
+	tunnel, ok := r.tunnels[id]
+	r.mutex.RUnlock()
+	return tunnel, ok
+}
+
 func (r *tunnelRegistry) get(id tunnelID) (*requestChannel, bool) {
 	r.mutex.RLock()
 	session, ok := r.sessions[id]
@@ -136,12 +503,101 @@ func (r *tunnelRegistry) get(id tunnelID) (*requestChannel, bool) {
 
 func (r *tunnelRegistry) clear(id tunnelID) {
 	r.mutex.Lock()
+	r.remove(id)
+	r.mutex.Unlock()
+}
+
+// remove must be called with the lock held, the tunnel
+// goes away along with its last session
+func (r *tunnelRegistry) remove(id tunnelID) {
 	session, ok := r.sessions[id]
-	if ok {
-		session.close()
+	if !ok {
+		return
 	}
+	session.close()
 	delete(r.sessions, id)
-	delete(r.ids, id.id)
+	if tunnel, ok := r.tunnels[id.id]; ok && tunnel.remove(session) == 0 {
+		tunnel.close()
+		delete(r.tunnels, id.id)
+	}
+}
+
+// release is called once a client's stream ends, without a grace period
+// the session is cleared right away, otherwise it's left for the reaper
+// so that the client can reconnect to it
+func (r *tunnelRegistry) release(id tunnelID) {
+	session, ok := r.get(id)
+	if r.gracePeriod == 0 || (ok && session.isDraining()) {
+		r.clear(id)
+	}
+}
+
+// draining checks whether every session for the id is draining
+func (r *tunnelRegistry) draining(id string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	tunnel, ok := r.tunnels[id]
+	if !ok {
+		return false
+	}
+	tunnel.mutex.RLock()
+	defer tunnel.mutex.RUnlock()
+
+	for _, member := range tunnel.members {
+		if !member.isDraining() {
+			return false
+		}
+	}
+	return len(tunnel.members) > 0
+}
+
+// drain drains the sessions for the id, or every session if the id is
+// empty, and tells their clients to go away, it returns the sessions
+// that were drained
+func (r *tunnelRegistry) drain(id string) []tunnelID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var drained []tunnelID
+	for tunnelID, session := range r.sessions {
+		if id != "" && tunnelID.id != id {
+			continue
+		}
+		session.drain()
+		go session.goAway()
+		drained = append(drained, tunnelID)
+	}
+	return drained
+}
+
+// wait blocks until the given sessions have nothing left in flight
+func (r *tunnelRegistry) wait(ctx context.Context, ids []tunnelID) error {
+	for {
+		busy := false
+		for _, id := range ids {
+			if session, ok := r.get(id); ok && session.inFlight() > 0 {
+				busy = true
+				break
+			}
+		}
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// close clears every session
+func (r *tunnelRegistry) close() {
+	r.mutex.Lock()
+	for id := range r.sessions {
+		r.remove(id)
+	}
 	r.mutex.Unlock()
 }
 
@@ -156,9 +612,8 @@ func (r *tunnelRegistry) reap(ctx context.Context) {
 				session.mutex.RLock()
 				lastHeartbeat := session.heartbeat
 				session.mutex.RUnlock()
-				if time.Since(lastHeartbeat) > heartbeatTimeout*2 {
-					session.close()
-					delete(r.sessions, id)
+				if time.Since(lastHeartbeat) > heartbeatTimeout*2+r.gracePeriod {
+					r.remove(id)
 				}
 			}
 			r.mutex.Unlock()
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+)
+
+func TestReconnectOnlyAbortsTheOldStreamsRequests(t *testing.T) {
+	session := newRequestChannel(ProtocolHTTP, newCodec("", 0))
+	defer session.close()
+	ctx := context.Background()
+
+	// the old stream hangs while sending its request, so the
+	// next one has to go over the new stream
+	hangUp := make(chan struct{})
+	oldDone := make(chan struct{})
+	go func() {
+		defer close(oldDone)
+		_ = session.handle(func(*proto.APIRequest) error {
+			<-hangUp
+			return errors.New("stream closed")
+		}, func() (*proto.APIResponse, error) {
+			<-hangUp
+			return nil, io.EOF
+		})
+	}()
+	old := session.open(false)
+	if err := session.send(ctx, &proto.APIRequest{Id: old.id, Frame: proto.FrameType_FRAME_HEADER}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan *proto.APIRequest, 1)
+	go func() {
+		_ = session.handle(func(request *proto.APIRequest) error {
+			sent <- request
+			return nil
+		}, func() (*proto.APIResponse, error) {
+			<-session.ctx.Done()
+			return nil, io.EOF
+		})
+	}()
+	current := session.open(false)
+	if err := session.send(ctx, &proto.APIRequest{Id: current.id, Frame: proto.FrameType_FRAME_HEADER}); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-sent; request.Id != current.id {
+		t.Fatalf("sent %d over the new stream", request.Id)
+	}
+
+	close(hangUp)
+	<-oldDone
+
+	select {
+	case <-old.aborted:
+	case <-time.After(time.Second):
+		t.Fatal("the old stream's request wasn't aborted")
+	}
+	select {
+	case <-current.aborted:
+		t.Fatal("the new stream's request was aborted")
+	default:
+	}
+}
+
+func TestReconnectReplacesTheOldStream(t *testing.T) {
+	session := newRequestChannel(ProtocolHTTP, newCodec("", 0))
+	defer session.close()
+	ctx := context.Background()
+
+	// the old stream's connection is gone but nobody noticed
+	oldDone := make(chan struct{})
+	go func() {
+		defer close(oldDone)
+		_ = session.handle(func(request *proto.APIRequest) error {
+			return nil
+		}, func() (*proto.APIResponse, error) {
+			<-session.ctx.Done()
+			return nil, io.EOF
+		})
+	}()
+	old := session.open(false)
+	if err := session.send(ctx, &proto.APIRequest{Id: old.id, Frame: proto.FrameType_FRAME_HEADER}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan *proto.APIRequest, 4)
+	go func() {
+		_ = session.handle(func(request *proto.APIRequest) error {
+			sent <- request
+			return nil
+		}, func() (*proto.APIResponse, error) {
+			<-session.ctx.Done()
+			return nil, io.EOF
+		})
+	}()
+	select {
+	case <-oldDone:
+	case <-time.After(time.Second):
+		t.Fatal("the old stream is still around")
+	}
+	select {
+	case <-old.aborted:
+	default:
+		t.Fatal("the old stream's request wasn't aborted")
+	}
+
+	for i := 0; i < cap(sent); i++ {
+		pending := session.open(false)
+		if err := session.send(ctx, &proto.APIRequest{Id: pending.id, Frame: proto.FrameType_FRAME_HEADER}); err != nil {
+			t.Fatal(err)
+		}
+		if request := <-sent; request.Id != pending.id {
+			t.Fatalf("sent %d over the new stream", request.Id)
+		}
+	}
+}
+
+func TestReconnectedClientStaysHealthy(t *testing.T) {
+	session := newRequestChannel(ProtocolHTTP, newCodec("", 0))
+	defer session.close()
+	defer session.attach()()
+
+	// the old Heartbeat stream closes after the new one opened
+	stopOld := session.beat()
+	defer session.beat()()
+	stopOld()
+
+	if !session.healthy() {
+		t.Fatal("the reconnected client isn't healthy")
+	}
+}
@@ -2,29 +2,32 @@ package tunnel
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrewstucki/light/tunnel/proto"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/idna"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	maxRequestSize = 1 * 1 << 20   // 1 MB
-	maxMessage     = 600 * 1 << 20 // 600 MB
-	maxBodySize    = 500 * 1 << 20 // 500 MB
+	maxMessage    = 4 * 1 << 20  // 4 MB
+	bodyChunkSize = 32 * 1 << 10 // 32 KB
 )
 
 type ServerConfig struct {
@@ -35,26 +38,100 @@ type ServerConfig struct {
 	ACMEEmailAddress     string
 	CertificateDirectory string
 	Token                string
+	// TCPPortStart and TCPPortEnd are the range of public
+	// ports handed out to TCP tunnels, leave them unset to
+	// disable TCP tunnels entirely
+	TCPPortStart int
+	TCPPortEnd   int
+	// UDPPortStart and UDPPortEnd are the same for UDP tunnels
+	UDPPortStart int
+	UDPPortEnd   int
+	// ForwardedHeaders adds X-Forwarded-For, X-Forwarded-Proto,
+	// X-Forwarded-Host and Forwarded headers to tunneled requests
+	ForwardedHeaders bool
+	// TrustedProxies are the IPs or CIDRs of proxies in front of the
+	// server whose forwarding headers are kept, everyone else's get
+	// stripped so that visitors can't spoof them
+	TrustedProxies []string
+	// ReconnectGracePeriod is how long a tunnel id is held for its
+	// client after it disconnects
+	ReconnectGracePeriod time.Duration
+	// DrainTimeout bounds how long in-flight requests are
+	// waited on when draining tunnels or shutting down
+	DrainTimeout time.Duration
+	// MaxInFlight bounds how many requests each tunnel works on at
+	// once, up to MaxQueued more wait for at most QueueTimeout before
+	// visitors get turned away, leave it unset for no bounds
+	MaxInFlight  int
+	MaxQueued    int
+	QueueTimeout time.Duration
+	// UpstreamTimeout bounds how long the server waits on a client
+	// to start responding to a request before giving the visitor a
+	// 504, responses that have started streaming aren't cut off,
+	// clients can ask for a shorter one for their own tunnels
+	UpstreamTimeout time.Duration
+	// Compression lists the encodings, gzip and zstd, that bodies can
+	// be compressed with over the tunnel, the client picks one of them,
+	// bodies smaller than CompressionThreshold are never compressed
+	Compression          []string
+	CompressionThreshold int
+	// SinglePort serves the gRPC tunnel service on HTTPPort alongside
+	// public traffic rather than on GRPCPort, it's always served over
+	// TLS, with the server's own certificate if ACME isn't enabled
+	SinglePort bool
+	// CACertificate and CAKey are the files the CA that issues session
+	// certificates is kept in, it's created there if they don't exist,
+	// leave them unset to get a new CA every time the server starts
+	CACertificate string
+	CAKey         string
+	// CAOverlap is how long a CA that was rotated out stays trusted,
+	// it defaults to DefaultCAOverlap
+	CAOverlap time.Duration
+	// CertificateTTL is how long session certificates are good for,
+	// clients renew theirs while they're connected, it defaults to
+	// DefaultCertificateTTL
+	CertificateTTL time.Duration
 }
 
 type tunnelServer struct {
-	host     string
-	token    string
-	port     int
-	registry *tunnelRegistry
-	router   *mux.Router
+	host      string
+	token     string
+	registry  *tunnelRegistry
+	tcpPorts  *portAllocator
+	udpPorts  *portAllocator
+	forwarded *forwardedHeaders
+	router    *mux.Router
+	// websockets are connections from clients that couldn't
+	// reach the gRPC port, passed on to the gRPC server
+	websockets *connListener
+	// authority issues the session certificates, each good for certificateTTL
+	authority      *authority
+	certificateTTL time.Duration
+
+	drainTimeout    time.Duration
+	upstreamTimeout time.Duration
+	draining        int32
+
+	compression          []string
+	compressionThreshold int
 }
 
-func newTunnelServer(port int, host, token string, registry *tunnelRegistry) *tunnelServer {
+func newTunnelServer(host, token string, registry *tunnelRegistry, tcpPorts, udpPorts *portAllocator, forwarded *forwardedHeaders, drainTimeout, upstreamTimeout time.Duration) *tunnelServer {
 	server := &tunnelServer{
-		port:     port,
-		token:    token,
-		host:     host,
-		registry: registry,
+		token:           token,
+		host:            host,
+		registry:        registry,
+		tcpPorts:        tcpPorts,
+		udpPorts:        udpPorts,
+		forwarded:       forwarded,
+		drainTimeout:    drainTimeout,
+		upstreamTimeout: upstreamTimeout,
+		websockets:      newConnListener(),
 	}
 	router := mux.NewRouter()
 	hostRouter := router.Host(host).Subrouter()
-	hostRouter.Methods("POST").Path("/connect").HandlerFunc(server.Connect)
+	hostRouter.Methods("GET").Path(websocketPath).Handler(serveWebsocket(server.websockets))
+	hostRouter.Methods("POST").Path("/drain/{id}").HandlerFunc(server.DrainTunnel)
 	hostRouter.PathPrefix("/").HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 		response.WriteHeader(http.StatusNotFound)
 	})
@@ -65,86 +142,293 @@ func newTunnelServer(port int, host, token string, registry *tunnelRegistry) *tu
 
 func (t *tunnelServer) Handler(response http.ResponseWriter, request *http.Request) {
 	id := strings.TrimSuffix(request.Host, "."+t.host)
-	session, ok := t.registry.sessionByID(id)
-	if !ok {
+	tunnel, ok := t.registry.tunnel(id)
+	if !ok && t.isDraining() {
+		response.Header().Set("Retry-After", strconv.Itoa(int(t.drainTimeout.Seconds())))
+		response.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !ok || tunnel.protocol != ProtocolHTTP {
 		response.WriteHeader(http.StatusNotFound)
 		return
 	}
-	req, err := httpRequestToProto(request)
+
+	// the timeout only covers waiting on the response to start,
+	// responses that are streaming can take as long as they like
+	ctx := request.Context()
+	waitCtx := ctx
+	if tunnel.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, tunnel.timeout)
+		defer cancel()
+	}
+
+	release, err := tunnel.queue.acquire(waitCtx)
+	if err == context.DeadlineExceeded {
+		response.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
-		if err == io.EOF {
-			response.WriteHeader(http.StatusRequestEntityTooLarge)
+		response.Header().Set("Retry-After", strconv.Itoa(tunnel.queue.retryAfter()))
+		response.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	session, ok := tunnel.pick()
+	if !ok && (t.isDraining() || t.registry.draining(id)) {
+		response.Header().Set("Retry-After", strconv.Itoa(int(t.drainTimeout.Seconds())))
+		response.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !ok {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if t.forwarded != nil {
+		t.forwarded.apply(request)
+	}
+
+	upgrade := httpguts.HeaderValuesContainsToken(request.Header["Connection"], "Upgrade")
+	pending := session.open(upgrade)
+	defer session.finish(pending)
+
+	req := httpRequestToProto(pending.id, request)
+	if deadline, ok := waitCtx.Deadline(); ok && !upgrade && session.features.has(featureTimeouts) {
+		// upgraded connections only have until they're spliced
+		req.Timeout = time.Until(deadline).Milliseconds()
+		if req.Timeout < 1 {
+			req.Timeout = 1
+		}
+	}
+	if err := session.send(waitCtx, req); err != nil {
+		if waitCtx.Err() == context.DeadlineExceeded {
+			response.WriteHeader(http.StatusGatewayTimeout)
 			return
 		}
-		response.WriteHeader(http.StatusInternalServerError)
+		response.WriteHeader(http.StatusNotFound)
 		return
 	}
-	resp, err := session.send(request.Context(), req)
-	if err != nil {
-		if err == io.EOF {
+	go func() {
+		defer request.Body.Close()
+		_ = session.sendBody(ctx, pending, request.Body, request.Trailer, session.codec.compresses(request.Header))
+	}()
+
+	// upgraded connections can stay open for as long as they like,
+	// they'd starve everything else if they kept their slots
+	started, err := convert(ctx, waitCtx.Done(), session, pending, response, release)
+	if err != nil && !started {
+		switch {
+		case err == context.DeadlineExceeded:
+			response.WriteHeader(http.StatusGatewayTimeout)
+		case err == io.EOF:
 			response.WriteHeader(http.StatusNotFound)
-		} else {
+		case err == errDisconnected:
+			response.WriteHeader(http.StatusBadGateway)
+		default:
 			response.WriteHeader(http.StatusInternalServerError)
 		}
-		return
 	}
-	convert(resp, response)
+	if err != nil && err != errDisconnected {
+		// let the client know it can stop working on the request, the
+		// visitor isn't kept waiting on a client that might be gone
+		go func() {
+			_ = session.cancelRequest(pending.id)
+		}()
+	}
 }
 
-type connectRequest struct {
-	ID string `json:"id"`
+// features are the ones the client announced that we can do for it,
+// it can only count on forwarding headers if we're adding them
+func (t *tunnelServer) features(announced []string) featureSet {
+	features := newFeatureSet(announced)
+	if t.forwarded == nil {
+		delete(features, featureForwarded)
+	}
+	return features
 }
 
-type connectResponse struct {
-	Port        int    `json:"port"`
-	CA          []byte `json:"ca"`
-	PrivateKey  []byte `json:"privateKey"`
-	Certificate []byte `json:"certificate"`
+// passthrough finds the TLS passthrough tunnel for a server name
+func (t *tunnelServer) passthrough(serverName string) (*requestChannel, bool) {
+	id := strings.TrimSuffix(serverName, "."+t.host)
+	if id == serverName {
+		return nil, false
+	}
+	session, ok := t.registry.sessionByID(id)
+	if !ok || session.protocol != ProtocolTLS {
+		return nil, false
+	}
+	return session, true
 }
 
-func (t *tunnelServer) Connect(response http.ResponseWriter, request *http.Request) {
-	defer request.Body.Close()
+// Register creates a new session for a client, handing back the
+// certificate that it authenticates everything else with
+func (t *tunnelServer) Register(ctx context.Context, req *proto.RegisterRequest) (*proto.RegisterResponse, error) {
+	if t.token != "" && req.Token != t.token {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if t.isDraining() {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
 
-	if t.token != "" {
-		// check static token
-		token := request.Header.Get("X-Tunnel-Token")
-		if token != t.token {
-			response.WriteHeader(http.StatusUnauthorized)
-			return
+	version, err := negotiateVersion(int(req.Version))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	features := t.features(req.Features)
+
+	csr, err := parseRequest(req.Csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid certificate signing request: %v", err)
+	}
+	id, err := idna.Lookup.ToASCII(req.Id)
+	if err != nil || id == "" || strings.Contains(id, ".") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid id %q", req.Id)
+	}
+	if id == sessionServerName {
+		// it's the name clients know the server itself by
+		return nil, status.Errorf(codes.InvalidArgument, "id %q is reserved", req.Id)
+	}
+	protocol := Protocol(req.Protocol)
+	if protocol == "" {
+		protocol = ProtocolHTTP
+	}
+	strategy := Strategy(req.Strategy)
+	if !strategy.valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown strategy %q", req.Strategy)
+	}
+
+	var listen func(tunnel *tunnelPool) (io.Closer, int, error)
+	switch protocol {
+	case ProtocolHTTP, ProtocolTLS:
+	case ProtocolTCP:
+		listen = func(tunnel *tunnelPool) (io.Closer, int, error) {
+			listener, port, err := t.tcpPorts.listen()
+			if err != nil {
+				return nil, 0, err
+			}
+			go serveConnections(tunnel, listener)
+			return listener, port, nil
 		}
+	case ProtocolUDP:
+		listen = func(tunnel *tunnelPool) (io.Closer, int, error) {
+			conn, port, err := t.udpPorts.listenPacket()
+			if err != nil {
+				return nil, 0, err
+			}
+			go serveDatagrams(tunnel, conn)
+			return conn, port, nil
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown protocol %q", req.Protocol)
 	}
 
-	req := &connectRequest{}
-	decoder := json.NewDecoder(request.Body)
-	if err := decoder.Decode(req); err != nil {
-		response.WriteHeader(http.StatusBadRequest)
-		return
+	timeout := t.upstreamTimeout
+	if requested := time.Duration(req.Timeout) * time.Millisecond; requested > 0 && (timeout == 0 || requested < timeout) {
+		timeout = requested
+	}
+
+	var encoding string
+	if features.has(featureCompression) {
+		encoding = negotiateEncoding(req.Compression, t.compression)
+	}
+	nonce, publicPort, created, err := t.registry.createSession(id, sessionOptions{
+		protocol: protocol,
+		strategy: strategy,
+		standby:  req.Standby,
+		timeout:  timeout,
+		codec:    newCodec(encoding, t.compressionThreshold),
+		features: features,
+	}, listen)
+	if err == errNoPorts {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
 	}
-	nonce, created, err := t.registry.createSession(req.ID)
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !created {
-		response.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, status.Errorf(codes.AlreadyExists, "id %q is already in use", id)
 	}
-	certificate, privateKey, err := rootCA.generate(req.ID, nonce)
+	// the session's identity is ours to decide, not the client's
+	certificate, err := t.authority.sign(id, nonce, csr.PublicKey, t.certificateTTL)
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	encoder := json.NewEncoder(response)
-	if err := encoder.Encode(&connectResponse{
-		Port:        t.port,
-		CA:          rootCA.PEM,
-		PrivateKey:  privateKey,
+	return &proto.RegisterResponse{
+		Ca:          t.authority.trusted(),
 		Certificate: certificate,
-	}); err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
+		PublicPort:  int32(publicPort),
+		Compression: encoding,
+		Version:     int32(version),
+		Features:    features.list(),
+	}, nil
+}
+
+// Renew issues a new certificate for the caller's session, the
+// client's key can change along with it but its identity can't
+func (t *tunnelServer) Renew(ctx context.Context, req *proto.RenewRequest) (*proto.RenewResponse, error) {
+	tunnelID := id(ctx)
+	if _, found := t.registry.get(tunnelID); !found {
+		return nil, status.Errorf(codes.NotFound, "client not found")
+	}
+	csr, err := parseRequest(req.Csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid certificate signing request: %v", err)
+	}
+	certificate, err := t.authority.sign(tunnelID.id, tunnelID.nonce, csr.PublicKey, t.certificateTTL)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &proto.RenewResponse{
+		Ca:          t.authority.trusted(),
+		Certificate: certificate,
+	}, nil
+}
+
+// DrainTunnel drains a single tunnel, its clients are told to go
+// away once whatever they're handling is done
+func (t *tunnelServer) DrainTunnel(response http.ResponseWriter, request *http.Request) {
+	if !t.authorized(request) {
+		response.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+
+	id := mux.Vars(request)["id"]
+	if _, ok := t.registry.sessionByID(id); !ok {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), t.drainTimeout)
+		defer cancel()
+		t.drain(ctx, id)
+	}()
+	response.WriteHeader(http.StatusAccepted)
+}
+
+func (t *tunnelServer) authorized(request *http.Request) bool {
+	// check static token
+	return t.token == "" || request.Header.Get("X-Tunnel-Token") == t.token
+}
+
+func (t *tunnelServer) isDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+// drain stops sending new work to the tunnel with the given id, or to every
+// tunnel if the id is empty, waits on everything in flight and then clears
+// the sessions so that their clients reconnect
+func (t *tunnelServer) drain(ctx context.Context, id string) {
+	if id == "" {
+		atomic.StoreInt32(&t.draining, 1)
+	}
+	drained := t.registry.drain(id)
+	_ = t.registry.wait(ctx, drained)
+	for _, id := range drained {
+		t.registry.clear(id)
+	}
 }
 
 func (t *tunnelServer) ReverseServe(stream proto.Tunnel_ReverseServeServer) error {
@@ -153,14 +437,53 @@ func (t *tunnelServer) ReverseServe(stream proto.Tunnel_ReverseServeServer) erro
 	if !found {
 		return status.Errorf(codes.NotFound, "client not found")
 	}
-	defer t.registry.clear(id(ctx))
+	defer t.registry.release(id(ctx))
 
-	if err := session.handle(func(request *proto.APIRequest) (*proto.APIResponse, error) {
-		if err := stream.Send(request); err != nil {
-			return nil, err
+	if err := session.handle(stream.Send, stream.Recv); err != nil {
+		if err != io.EOF {
+			return status.Errorf(codes.Internal, err.Error())
 		}
-		return stream.Recv()
-	}); err != nil {
+	}
+	return nil
+}
+
+func (t *tunnelServer) Splice(stream proto.Tunnel_SpliceServer) error {
+	ctx := stream.Context()
+	session, found := t.registry.get(id(ctx))
+	if !found {
+		return status.Errorf(codes.NotFound, "client not found")
+	}
+
+	// the first chunk just tells us which request we're splicing
+	chunk, err := stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	done, ok := session.splice(chunk.Id, stream)
+	if !ok {
+		return status.Errorf(codes.NotFound, "upgrade request not found")
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-session.ctx.Done():
+	}
+	return nil
+}
+
+func (t *tunnelServer) Listen(_ *proto.Empty, stream proto.Tunnel_ListenServer) error {
+	ctx := stream.Context()
+	session, found := t.registry.get(id(ctx))
+	if !found {
+		return status.Errorf(codes.NotFound, "client not found")
+	}
+	defer t.registry.release(id(ctx))
+
+	if err := session.accept(ctx, stream.Send); err != nil {
 		if err != io.EOF {
 			return status.Errorf(codes.Internal, err.Error())
 		}
@@ -168,12 +491,24 @@ func (t *tunnelServer) ReverseServe(stream proto.Tunnel_ReverseServeServer) erro
 	return nil
 }
 
+// Drain is called by clients that are shutting down, they
+// stop getting new work but finish what they're working on
+func (t *tunnelServer) Drain(ctx context.Context, _ *proto.Empty) (*proto.Empty, error) {
+	session, found := t.registry.get(id(ctx))
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "client not found")
+	}
+	session.drain()
+	return &proto.Empty{}, nil
+}
+
 func (t *tunnelServer) Heartbeat(stream proto.Tunnel_HeartbeatServer) error {
 	ctx := stream.Context()
 	session, found := t.registry.get(id(ctx))
 	if !found {
 		return status.Errorf(codes.NotFound, "client not found")
 	}
+	defer session.beat()()
 
 	for {
 		_, err := stream.Recv()
@@ -190,75 +525,165 @@ func (t *tunnelServer) Heartbeat(stream proto.Tunnel_HeartbeatServer) error {
 }
 
 func RunServer(ctx context.Context, config ServerConfig) error {
-	listener, err := net.Listen("tcp", config.Address+":"+strconv.Itoa(config.GRPCPort))
+	var listener net.Listener
+	if !config.SinglePort {
+		var err error
+		listener, err = net.Listen("tcp", config.Address+":"+strconv.Itoa(config.GRPCPort))
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+	}
+
+	var forwarded *forwardedHeaders
+	if config.ForwardedHeaders {
+		var err error
+		forwarded, err = newForwardedHeaders(config.TrustedProxies)
+		if err != nil {
+			return err
+		}
+	}
+
+	registry := newTunnelRegistry(config.ReconnectGracePeriod, config.MaxInFlight, config.MaxQueued, config.QueueTimeout)
+	tcpPorts := newPortAllocator(config.Address, config.TCPPortStart, config.TCPPortEnd)
+	udpPorts := newPortAllocator(config.Address, config.UDPPortStart, config.UDPPortEnd)
+	drainTimeout := config.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	authority, err := loadAuthority(config.CACertificate, config.CAKey, config.CAOverlap)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
+	server := newTunnelServer(config.Host, config.Token, registry, tcpPorts, udpPorts, forwarded, drainTimeout, config.UpstreamTimeout)
+	server.authority = authority
+	server.certificateTTL = config.CertificateTTL
+	if config.CertificateTTL == 0 {
+		server.certificateTTL = DefaultCertificateTTL
+	}
+	server.compression = config.Compression
+	server.compressionThreshold = config.CompressionThreshold
 
-	registry := newTunnelRegistry()
-	server := newTunnelServer(config.GRPCPort, config.Host, config.Token, registry)
+	var cache autocert.Cache
+	cache = newCertCache()
+	if config.CertificateDirectory != "" {
+		cache = autocert.DirCache(config.CertificateDirectory)
+	}
+	manager := &autocert.Manager{
+		Cache:  cache,
+		Prompt: autocert.AcceptTOS,
+		Email:  config.ACMEEmailAddress,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if host == config.Host {
+				return nil
+			}
+			h, err := idna.Lookup.ToASCII(host)
+			if err != nil {
+				return err
+			}
+			isSubdomain := strings.HasSuffix(h, "."+config.Host)
+			if !isSubdomain {
+				return fmt.Errorf("host %q is not an allowed host", host)
+			}
+			// check that we have only a single level of subdomain
+			trimmed := strings.TrimSuffix(h, "."+config.Host)
+			if strings.Contains(trimmed, ".") {
+				return fmt.Errorf("host %q is not an allowed host", host)
+			}
+			return nil
+		},
+	}
+	// clients registering check the gRPC port's certificate
+	// against the same public one the HTTP port serves
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if config.ACMEEmailAddress != "" {
+		getCertificate = manager.GetCertificate
+	}
 	grpcServer := grpc.NewServer(
 		grpc.MaxRecvMsgSize(maxMessage),
-		grpc.Creds(serverCredentials),
+		grpc.Creds(authority.credentials(config.Host, getCertificate)),
 		grpc.StreamInterceptor(spiffeStreamMiddleware),
+		grpc.UnaryInterceptor(spiffeUnaryMiddleware),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             heartbeatTimeout,
+			PermitWithoutStream: true,
+		}),
+		// clients whose connections dropped without saying
+		// so are noticed about as quickly as they notice us
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    heartbeatTimeout * 2,
+			Timeout: heartbeatTimeout,
+		}),
 	)
 	proto.RegisterTunnelServer(grpcServer, server)
 
 	group, ctx := errgroup.WithContext(ctx)
+	if !config.SinglePort {
+		group.Go(func() error {
+			return grpcServer.Serve(listener)
+		})
+	}
 	group.Go(func() error {
-		return grpcServer.Serve(listener)
+		return grpcServer.Serve(server.websockets)
 	})
 	group.Go(func() error {
-		var cache autocert.Cache
-		cache = newCertCache()
-		if config.CertificateDirectory != "" {
-			cache = autocert.DirCache(config.CertificateDirectory)
-		}
-		manager := &autocert.Manager{
-			Cache:  cache,
-			Prompt: autocert.AcceptTOS,
-			Email:  config.ACMEEmailAddress,
-			HostPolicy: func(ctx context.Context, host string) error {
-				if host == config.Host {
-					return nil
-				}
-				h, err := idna.Lookup.ToASCII(host)
-				if err != nil {
-					return err
-				}
-				isSubdomain := strings.HasSuffix(h, "."+config.Host)
-				if !isSubdomain {
-					return fmt.Errorf("host %q is not an allowed host", host)
-				}
-				// check that we have only a single level of subdomain
-				trimmed := strings.TrimSuffix(h, "."+config.Host)
-				if strings.Contains(trimmed, ".") {
-					return fmt.Errorf("host %q is not an allowed host", host)
-				}
-				return nil
-			},
-		}
 		httpServer := http.Server{
-			Addr:    config.Address + ":" + strconv.Itoa(config.HTTPPort),
 			Handler: server.router,
 		}
 		if config.ACMEEmailAddress != "" {
 			httpServer.TLSConfig = manager.TLSConfig()
 		}
+		if config.SinglePort {
+			httpServer.Handler = multiplex(config.Host, grpcServer, server.router)
+			httpServer.TLSConfig = singlePortTLSConfig(config.Host, authority, httpServer.TLSConfig, getCertificate)
+		}
+
+		httpListener, err := net.Listen("tcp", config.Address+":"+strconv.Itoa(config.HTTPPort))
+		if err != nil {
+			grpcServer.Stop()
+			return err
+		}
+		// passthrough tunnels get routed off before TLS is ever terminated
+		publicListener := newSNIListener(httpListener, server.passthrough)
 
 		errs := make(chan error, 1)
 		go func() {
-			if config.ACMEEmailAddress != "" {
-				errs <- httpServer.ListenAndServeTLS("", "")
+			if httpServer.TLSConfig != nil {
+				errs <- httpServer.ServeTLS(publicListener, "", "")
 			} else {
-				errs <- httpServer.ListenAndServe()
+				errs <- httpServer.Serve(publicListener)
 			}
 		}()
 		select {
 		case <-ctx.Done():
-			grpcServer.Stop()
-			httpServer.Shutdown(ctx)
+			drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+
+			// let everything in flight finish before hanging up on the clients
+			server.drain(drainCtx, "")
+			if config.SinglePort {
+				// the tunnel streams are requests to the HTTP server too,
+				// which would otherwise hold up its shutdown, and the gRPC
+				// server can't gracefully stop streams it didn't accept
+				registry.close()
+				grpcServer.Stop()
+				httpServer.Shutdown(drainCtx)
+				<-errs
+				return nil
+			}
+			httpServer.Shutdown(drainCtx)
+			registry.close()
+
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-drainCtx.Done():
+				grpcServer.Stop()
+			}
 			<-errs
 			return nil
 		case err := <-errs:
@@ -267,6 +692,56 @@ func RunServer(ctx context.Context, config ServerConfig) error {
 		}
 	})
 	go registry.reap(ctx)
+	go authority.run(ctx)
 
 	return group.Wait()
 }
+
+// multiplex hands gRPC calls made to the bare host over to the
+// tunnel service and everything else to the public router
+func multiplex(host string, grpcServer *grpc.Server, router http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestHost, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			requestHost = request.Host
+		}
+		// clients using their session certificates call the
+		// server by the name its own certificate is issued for
+		tunnelHost := requestHost == host || requestHost == sessionServerName
+		if request.ProtoMajor == 2 && tunnelHost && strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(response, request)
+			return
+		}
+		router.ServeHTTP(response, request)
+	})
+}
+
+// singlePortTLSConfig wraps the public TLS configuration so that clients
+// dialing the bare host, or the server name that session certificates
+// are checked against, get asked for their certificates
+func singlePortTLSConfig(host string, authority *authority, public *tls.Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	tunnel := authority.tlsConfig(host, getCertificate)
+	tunnel.NextProtos = []string{"h2", "http/1.1"}
+	if public == nil {
+		public = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return authority.serverCertificate(), nil
+			},
+			NextProtos: tunnel.NextProtos,
+		}
+	}
+	public = public.Clone()
+	public.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, protocol := range hello.SupportedProtos {
+			if protocol == acme.ALPNProto {
+				// leave ACME's own challenges alone
+				return nil, nil
+			}
+		}
+		if hello.ServerName == host || hello.ServerName == sessionServerName {
+			return tunnel, nil
+		}
+		return nil, nil
+	}
+	return public
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+)
+
+type chunkStream interface {
+	Send(*proto.Chunk) error
+	Recv() (*proto.Chunk, error)
+}
+
+type spliceAddr struct{}
+
+func (spliceAddr) Network() string { return "splice" }
+func (spliceAddr) String() string  { return "splice" }
+
+// spliceConn adapts a Splice stream to a net.Conn
+type spliceConn struct {
+	stream chunkStream
+	chunk  []byte
+	closer func()
+	remote net.Addr
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+	closed     bool
+}
+
+var _ net.Conn = &spliceConn{}
+
+// newSpliceConn
+func newSpliceConn(stream chunkStream, closer func()) *spliceConn {
+	return &spliceConn{
+		stream: stream,
+		closer: closer,
+	}
+}
+
+func (s *spliceConn) Read(data []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	for len(s.chunk) == 0 {
+		chunk, err := s.stream.Recv()
+		if err != nil {
+			return 0, io.EOF
+		}
+		s.chunk = chunk.Data
+	}
+	n := copy(data, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+func (s *spliceConn) Write(data []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > bodyChunkSize {
+			n = bodyChunkSize
+		}
+		if err := s.stream.Send(&proto.Chunk{Data: data[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (s *spliceConn) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeMutex.Lock()
+		s.closed = true
+		s.writeMutex.Unlock()
+		if s.closer != nil {
+			s.closer()
+		}
+	})
+	return nil
+}
+
+func (s *spliceConn) LocalAddr() net.Addr { return spliceAddr{} }
+func (s *spliceConn) RemoteAddr() net.Addr {
+	if s.remote != nil {
+		return s.remote
+	}
+	return spliceAddr{}
+}
+func (s *spliceConn) SetDeadline(t time.Time) error      { return nil }
+func (s *spliceConn) SetReadDeadline(t time.Time) error  { return nil }
+func (s *spliceConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// openStream starts a Splice stream for the given request or connection
+func openStream(ctx context.Context, client proto.TunnelClient, id uint64) (proto.Tunnel_SpliceClient, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := client.Splice(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if err := stream.Send(&proto.Chunk{Id: id}); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, cancel, nil
+}
+
+// openSplice is openStream wrapped up as a net.Conn, remoteAddress
+// is the public address on the other end, if there is one
+func openSplice(ctx context.Context, client proto.TunnelClient, id uint64, remoteAddress string) (net.Conn, error) {
+	stream, cancel, err := openStream(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	conn := newSpliceConn(stream, func() {
+		stream.CloseSend()
+		cancel()
+	})
+	if remote, err := net.ResolveTCPAddr("tcp", remoteAddress); err == nil {
+		conn.remote = remote
+	}
+	return conn, nil
+}
+
+// bufferedConn makes sure we don't lose anything that was
+// already read off of a hijacked connection
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (b *bufferedConn) Read(data []byte) (int, error) {
+	return b.reader.Read(data)
+}
+
+// splice is handed from the Splice RPC to whoever is waiting on
+// the pending request, done is closed when they're finished with it
+type splice struct {
+	stream chunkStream
+	done   chan struct{}
+}
+
+// hijack takes over the public connection and pipes it to the client
+func hijack(response http.ResponseWriter, s *splice) error {
+	defer close(s.done)
+
+	hijacker, ok := response.(http.Hijacker)
+	if !ok {
+		return errors.New("connection does not support upgrades")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+
+	return pipe(&bufferedConn{Conn: conn, reader: buffered.Reader}, newSpliceConn(s.stream, nil))
+}
+
+// pipe copies data in both directions until either side stops, at
+// which point both are closed
+func pipe(a, b io.ReadWriteCloser) error {
+	// buffered so that the copy still running when we return
+	// doesn't block after its connection is closed
+	errs := make(chan error, 2)
+	copy := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		errs <- err
+	}
+	go copy(a, b)
+	go copy(b, a)
+
+	err := <-errs
+	a.Close()
+	b.Close()
+	return err
+}
@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+)
+
+// spliceTimeout is how long a public connection waits on
+// the client to open a Splice stream for it
+var spliceTimeout = 10 * time.Second
+
+// serveConnections hands every public connection off to a client
+func serveConnections(tunnel *tunnelPool, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session, ok := tunnel.pick()
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go forwardConnection(session, conn)
+	}
+}
+
+func forwardConnection(session *requestChannel, conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(session.ctx, spliceTimeout)
+	defer cancel()
+
+	pending := session.open(true)
+	defer session.finish(pending)
+
+	if err := session.connect(ctx, &proto.Connection{
+		Id:            pending.id,
+		RemoteAddress: conn.RemoteAddr().String(),
+	}); err != nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case splice := <-pending.splices:
+		defer close(splice.done)
+		_ = pipe(conn, newSpliceConn(splice.stream, nil))
+	}
+}
+
+// serveTCP dials the local address for every connection the server announces
+func serveTCP(ctx context.Context, client proto.TunnelClient, address string, work *inFlight) error {
+	stream, err := client.Listen(ctx, &proto.Empty{})
+	if err != nil {
+		return err
+	}
+
+	goingAway := false
+	for {
+		connection, err := stream.Recv()
+		if err != nil {
+			if goingAway {
+				return errGoingAway
+			}
+			return err
+		}
+		if connection.GoingAway {
+			goingAway = true
+			continue
+		}
+		done := work.track()
+		go func(connection *proto.Connection) {
+			defer done()
+			dialConnection(ctx, client, connection, address)
+		}(connection)
+	}
+}
+
+func dialConnection(ctx context.Context, client proto.TunnelClient, connection *proto.Connection, address string) {
+	// always open the splice so that the server can drop
+	// the public connection right away if we can't dial
+	remote, err := openSplice(ctx, client, connection.Id, connection.RemoteAddress)
+	if err != nil {
+		return
+	}
+
+	var dialer net.Dialer
+	local, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		remote.Close()
+		return
+	}
+	_ = pipe(local, remote)
+}
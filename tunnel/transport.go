@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// websocketPath is where the server accepts WebSocket tunnel connections
+const websocketPath = "/tunnel"
+
+// transportTimeout bounds how long we wait on a transport before
+// moving on to the next one, some networks silently drop
+// connections rather than refusing them
+const transportTimeout = 10 * time.Second
+
+// Transport carries the tunnel protocol between the client and the
+// server, gRPC runs over whatever connection it dials just as it
+// would over a plain TCP connection
+type Transport interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// directTransport dials the server's gRPC port
+type directTransport struct {
+	address string
+	dial    dialFunc
+}
+
+func (d *directTransport) Dial(ctx context.Context) (net.Conn, error) {
+	return d.dial(ctx, "tcp", d.address)
+}
+
+// websocketTransport tunnels gRPC through a WebSocket on the server's
+// public port, which makes it past proxies that only let HTTP/1.1 out
+type websocketTransport struct {
+	url  *url.URL
+	dial dialFunc
+}
+
+func newWebsocketTransport(serverURL *url.URL, dial dialFunc) *websocketTransport {
+	websocketURL := *serverURL
+	websocketURL.Scheme = "ws"
+	if serverURL.Scheme == "https" {
+		websocketURL.Scheme = "wss"
+	}
+	websocketURL.Path = websocketPath
+	return &websocketTransport{
+		url:  &websocketURL,
+		dial: dial,
+	}
+}
+
+func (w *websocketTransport) Dial(ctx context.Context) (net.Conn, error) {
+	config, err := websocket.NewConfig(w.url.String(), w.url.String())
+	if err != nil {
+		return nil, err
+	}
+
+	address := w.url.Host
+	if w.url.Port() == "" {
+		address = net.JoinHostPort(w.url.Hostname(), "80")
+		if w.url.Scheme == "wss" {
+			address = net.JoinHostPort(w.url.Hostname(), "443")
+		}
+	}
+	conn, err := w.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if w.url.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: w.url.Hostname(),
+			// WebSockets need the connection upgraded over HTTP/1.1
+			NextProtos: []string{"http/1.1"},
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// transportFailed checks whether a call failed because the server
+// couldn't be reached at all, rather than it turning us away
+func transportFailed(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// websocketConn is a WebSocket handed off to the gRPC server, closed
+// is closed along with it so that its handler knows when it's done
+type websocketConn struct {
+	*websocket.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (w *websocketConn) Close() error {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+	return w.Conn.Close()
+}
+
+// serveWebsocket upgrades the request and hands the connection
+// to the gRPC server, blocking until it's done with it
+func serveWebsocket(listener *connListener) http.Handler {
+	server := websocket.Server{
+		// clients aren't browsers, they don't have an origin to check
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			conn := &websocketConn{
+				Conn:   ws,
+				closed: make(chan struct{}),
+			}
+			listener.push(conn)
+			<-conn.closed
+		},
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if _, ok := response.(http.Hijacker); !ok {
+			http.Error(response, "websocket connections need HTTP/1.1", http.StatusBadRequest)
+			return
+		}
+		server.ServeHTTP(response, request)
+	})
+}
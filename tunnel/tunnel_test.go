@@ -0,0 +1,456 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestMain(m *testing.M) {
+	// the reaper gives up on silent clients within a second, it's set
+	// before anything that reads it starts up
+	heartbeatTimeout = 250 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// testTunnel is a server and a client connected to it in memory,
+// with visitors reaching the client's handler through the server
+type testTunnel struct {
+	server   *tunnelServer
+	registry *tunnelRegistry
+	session  *requestChannel
+	visitors *httptest.Server
+	// transport is how the client reaches the server
+	transport *bufconnTransport
+	// stop cancels the client, which drains before hanging up
+	stop context.CancelFunc
+	// served is closed once the client stops serving
+	served chan struct{}
+}
+
+// bufconnTransport stands in for the network
+type bufconnTransport struct {
+	listener *bufconn.Listener
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+func (b *bufconnTransport) Dial(ctx context.Context) (net.Conn, error) {
+	conn, err := b.listener.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	b.conns = append(b.conns, conn)
+	b.mutex.Unlock()
+	return conn, nil
+}
+
+// drop cuts the client off without it going through a drain
+func (b *bufconnTransport) drop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func startTunnel(t *testing.T, handler http.Handler) *testTunnel {
+	t.Helper()
+	return startTunnelWith(t, Config{
+		Protocol: ProtocolHTTP,
+		Handler:  handler,
+	})
+}
+
+// startTunnelWith lets the test configure the server before the
+// client registers with it
+func startTunnelWith(t *testing.T, config Config, configure ...func(*tunnelServer)) *testTunnel {
+	t.Helper()
+
+	registry := newTunnelRegistry(0, 0, 0, 0)
+	server := newTunnelServer("localhost", "", registry, nil, nil, nil, time.Second, 0)
+	for _, configure := range configure {
+		configure(server)
+	}
+	features := server.features(supportedFeatures)
+	nonce, _, _, err := registry.createSession("test", sessionOptions{
+		protocol: ProtocolHTTP,
+		timeout:  config.Timeout,
+		codec:    newCodec("", 0),
+		features: features,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := tunnelID{id: "test", nonce: nonce}
+	session, _ := registry.get(id)
+
+	// the interceptors stand in for the session certificate
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, wrapStream(stream, id))
+		}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(context.WithValue(ctx, idContextKey, id), req)
+		}),
+	)
+	proto.RegisterTunnelServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+
+	reapCtx, stopReaping := context.WithCancel(context.Background())
+	go registry.reap(reapCtx)
+
+	ctx, stop := context.WithCancel(context.Background())
+	tunnel := &testTunnel{
+		server:    server,
+		registry:  registry,
+		session:   session,
+		visitors:  httptest.NewServer(server.router),
+		transport: &bufconnTransport{listener: listener},
+		stop:      stop,
+		served:    make(chan struct{}),
+	}
+	go func() {
+		defer close(tunnel.served)
+		_, _ = serve(ctx, "bufconn", &registration{
+			id:          "test",
+			transport:   tunnel.transport,
+			codec:       newCodec("", 0),
+			features:    features,
+			credentials: insecure.NewCredentials(),
+			renewAt:     time.Now().Add(time.Hour),
+			expires:     time.Now().Add(time.Hour),
+		}, config)
+	}()
+
+	t.Cleanup(func() {
+		stop()
+		stopReaping()
+		registry.close()
+		grpcServer.Stop()
+		tunnel.visitors.CloseClientConnections()
+		tunnel.visitors.Close()
+	})
+	return tunnel
+}
+
+// request builds a visitor's request for the tunnel
+func (t *testTunnel) request(method, path string, body io.Reader) *http.Request {
+	request := httptest.NewRequest(method, t.visitors.URL+path, body)
+	request.RequestURI = ""
+	request.Host = "test.localhost"
+	return request
+}
+
+// get makes a request that has to complete within timeout
+func (t *testTunnel) get(path string, timeout time.Duration) (*http.Response, string, error) {
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Do(t.request(http.MethodGet, path, nil))
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	return response, string(body), err
+}
+
+// zeros is an endless body
+type zeros struct{}
+
+func (zeros) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = 0
+	}
+	return len(data), nil
+}
+
+func fastHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/fast" {
+			io.WriteString(response, "fast")
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+func TestSlowDownloadDoesNotStallOtherRequests(t *testing.T) {
+	tunnel := startTunnel(t, fastHandler(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// far more than the visitor, the server and the stream buffer
+		_, _ = io.Copy(response, io.LimitReader(zeros{}, 256<<20))
+	})))
+
+	// the visitor asks for the download and never reads any of it
+	visitor, err := net.Dial("tcp", tunnel.visitors.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	if _, err := io.WriteString(visitor, "GET /download HTTP/1.1\r\nHost: test.localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	// give it time to back up
+	time.Sleep(time.Second)
+
+	response, body, err := tunnel.get("/fast", 5*time.Second)
+	if err != nil {
+		t.Fatalf("fast request behind a slow download: %v", err)
+	}
+	if response.StatusCode != http.StatusOK || body != "fast" {
+		t.Fatalf("unexpected response %d %q", response.StatusCode, body)
+	}
+}
+
+func TestUnreadUploadDoesNotStallOtherRequests(t *testing.T) {
+	tunnel := startTunnel(t, fastHandler(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// never touches the body
+		<-request.Context().Done()
+	})))
+
+	uploadCtx, cancelUpload := context.WithCancel(context.Background())
+	defer cancelUpload()
+	go func() {
+		request := tunnel.request(http.MethodPost, "/upload", io.LimitReader(zeros{}, 256<<20)).WithContext(uploadCtx)
+		if response, err := http.DefaultClient.Do(request); err == nil {
+			response.Body.Close()
+		}
+	}()
+	time.Sleep(time.Second)
+
+	response, body, err := tunnel.get("/fast", 5*time.Second)
+	if err != nil {
+		t.Fatalf("fast request behind an unread upload: %v", err)
+	}
+	if response.StatusCode != http.StatusOK || body != "fast" {
+		t.Fatalf("unexpected response %d %q", response.StatusCode, body)
+	}
+}
+
+func TestLargeBodiesMakeItThrough(t *testing.T) {
+	const size = 32 << 20
+	tunnel := startTunnel(t, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			n, _ := io.Copy(io.Discard, request.Body)
+			fmt.Fprint(response, n)
+			return
+		}
+		_, _ = io.Copy(response, io.LimitReader(zeros{}, size))
+	}))
+
+	response, body, err := tunnel.get("/download", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || len(body) != size {
+		t.Fatalf("download got %d with %d bytes", response.StatusCode, len(body))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	upload, err := client.Do(tunnel.request(http.MethodPost, "/upload", io.LimitReader(zeros{}, size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Body.Close()
+	uploaded, _ := io.ReadAll(upload.Body)
+	if string(uploaded) != strconv.Itoa(size) {
+		t.Fatalf("upload got %q bytes through", uploaded)
+	}
+}
+
+func TestDrainingClientFinishesResponses(t *testing.T) {
+	const size = 256 << 10
+	for i := 0; i < 10; i++ {
+		tunnel := startTunnel(t, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			_, _ = io.Copy(response, io.LimitReader(zeros{}, size))
+		}))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			tunnel.stop()
+		}()
+		response, body, err := tunnel.get("/", 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || len(body) != size {
+			t.Fatalf("run %d got %d with %d bytes", i, response.StatusCode, len(body))
+		}
+	}
+}
+
+func TestDrainingClientKeepsHeartbeating(t *testing.T) {
+	tunnel := startTunnel(t, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// long enough for the reaper to have given up on a silent client
+		time.Sleep(4 * heartbeatTimeout)
+		io.WriteString(response, "done")
+	}))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tunnel.stop()
+	}()
+	response, body, err := tunnel.get("/", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || body != "done" {
+		t.Fatalf("unexpected response %d %q", response.StatusCode, body)
+	}
+}
+
+func TestUpgradesDontHoldInFlightSlots(t *testing.T) {
+	tunnel := startTunnel(t, fastHandler(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		conn, buffered, err := response.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_, _ = io.Copy(conn, buffered)
+	})))
+	pool, _ := tunnel.registry.tunnel("test")
+	pool.queue = newRequestQueue(1, 0, 0)
+
+	visitor, err := net.Dial("tcp", tunnel.visitors.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	io.WriteString(visitor, "GET /echo HTTP/1.1\r\nHost: test.localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade got %d", response.StatusCode)
+	}
+
+	// the upgraded connection stays open while other requests come in
+	response, body, err := tunnel.get("/fast", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || body != "fast" {
+		t.Fatalf("unexpected response %d %q", response.StatusCode, body)
+	}
+}
+
+func TestTimeoutOnlyCoversTheResponseStarting(t *testing.T) {
+	tunnel := startTunnelWith(t, Config{
+		Protocol: ProtocolHTTP,
+		Timeout:  500 * time.Millisecond,
+		Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if _, ok := request.Context().Deadline(); !ok {
+				t.Error("the handler can't see the deadline")
+			}
+			if request.URL.Path == "/slow" {
+				time.Sleep(time.Second)
+				if err := request.Context().Err(); err != context.DeadlineExceeded {
+					t.Errorf("slow handler's context ended with %v", err)
+				}
+			}
+			// streams for well past the timeout once it's started
+			for i := 0; i < 10; i++ {
+				io.WriteString(response, "x")
+				response.(http.Flusher).Flush()
+				time.Sleep(150 * time.Millisecond)
+			}
+		}),
+	})
+
+	response, body, err := tunnel.get("/stream", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || body != "xxxxxxxxxx" {
+		t.Fatalf("streaming response got %d %q", response.StatusCode, body)
+	}
+
+	response, _, err = tunnel.get("/slow", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("slow response got %d", response.StatusCode)
+	}
+}
+
+func TestForwardedOnlyWhenTheServerAddsHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(response, "%t %s", Forwarded(request), request.Header.Get("X-Forwarded-For"))
+	})
+	spoofed := func(tunnel *testTunnel) string {
+		request := tunnel.request(http.MethodGet, "/", nil)
+		request.Header.Set("X-Forwarded-For", "10.0.0.1")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	// the visitor's own header is all there is
+	if body := spoofed(startTunnel(t, handler)); body != "false 10.0.0.1" {
+		t.Fatalf("without forwarding headers got %q", body)
+	}
+
+	tunnel := startTunnelWith(t, Config{
+		Protocol: ProtocolHTTP,
+		Handler:  handler,
+	}, func(server *tunnelServer) {
+		server.forwarded, _ = newForwardedHeaders(nil)
+	})
+	if body := spoofed(tunnel); body != "true 127.0.0.1" {
+		t.Fatalf("with forwarding headers got %q", body)
+	}
+}
+
+func TestDroppedClientFailsRequestsRightAway(t *testing.T) {
+	tunnel := startTunnelWith(t, Config{
+		Protocol: ProtocolHTTP,
+		Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			<-request.Context().Done()
+		}),
+	}, func(server *tunnelServer) {
+		// the session sticks around waiting on the client to reconnect
+		server.registry.gracePeriod = 5 * time.Second
+	})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		tunnel.transport.drop()
+	}()
+	start := time.Now()
+	response, _, err := tunnel.get("/", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected response %d", response.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("took %s to fail the request", elapsed)
+	}
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andrewstucki/light/tunnel/proto"
+)
+
+const (
+	maxDatagramSize = 64 * 1 << 10 // 64 KB
+	// maxPendingDatagrams bounds how many datagrams a flow queues
+	// up before it starts dropping them
+	maxPendingDatagrams = 64
+)
+
+// udpIdleTimeout is how long a flow lives without seeing any traffic
+var udpIdleTimeout = 60 * time.Second
+
+// datagramFlow is all of the traffic from a single public source address
+type datagramFlow struct {
+	datagrams chan []byte
+	done      chan struct{}
+}
+
+type datagramFlows struct {
+	flows map[string]*datagramFlow
+	mutex sync.Mutex
+}
+
+// serveDatagrams tracks flows by source address, forwarding each
+// one to a client over its own Splice stream
+func serveDatagrams(tunnel *tunnelPool, conn net.PacketConn) {
+	flows := &datagramFlows{
+		flows: make(map[string]*datagramFlow),
+	}
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		datagram := append([]byte(nil), buffer[:n]...)
+
+		flows.mutex.Lock()
+		flow, ok := flows.flows[addr.String()]
+		if !ok {
+			session, ok := tunnel.pick()
+			if !ok {
+				flows.mutex.Unlock()
+				continue
+			}
+			flow = &datagramFlow{
+				datagrams: make(chan []byte, maxPendingDatagrams),
+				done:      make(chan struct{}),
+			}
+			flows.flows[addr.String()] = flow
+			go func() {
+				forwardFlow(session, conn, addr, flow)
+				flows.mutex.Lock()
+				delete(flows.flows, addr.String())
+				flows.mutex.Unlock()
+				close(flow.done)
+			}()
+		}
+		flows.mutex.Unlock()
+
+		select {
+		case flow.datagrams <- datagram:
+		case <-flow.done:
+		default:
+			// the flow is backed up, drop it like the network would
+		}
+	}
+}
+
+func forwardFlow(session *requestChannel, conn net.PacketConn, addr net.Addr, flow *datagramFlow) {
+	ctx, cancel := context.WithTimeout(session.ctx, spliceTimeout)
+	defer cancel()
+
+	pending := session.open(true)
+	defer session.finish(pending)
+
+	if err := session.connect(ctx, &proto.Connection{
+		Id:            pending.id,
+		RemoteAddress: addr.String(),
+	}); err != nil {
+		return
+	}
+
+	var splice *splice
+	select {
+	case <-ctx.Done():
+		return
+	case splice = <-pending.splices:
+	}
+	defer close(splice.done)
+
+	activity := make(chan struct{}, 1)
+	replies := make(chan struct{})
+	go func() {
+		defer close(replies)
+		for {
+			chunk, err := splice.stream.Recv()
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteTo(chunk.Data, addr); err != nil {
+				return
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	idle := time.NewTimer(udpIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-session.ctx.Done():
+			return
+		case <-replies:
+			return
+		case <-idle.C:
+			return
+		case <-activity:
+		case datagram := <-flow.datagrams:
+			if err := splice.stream.Send(&proto.Chunk{Data: datagram}); err != nil {
+				return
+			}
+		}
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(udpIdleTimeout)
+	}
+}
+
+// serveUDP relays every flow the server announces to the local address
+func serveUDP(ctx context.Context, client proto.TunnelClient, address string) error {
+	stream, err := client.Listen(ctx, &proto.Empty{})
+	if err != nil {
+		return err
+	}
+
+	goingAway := false
+	for {
+		connection, err := stream.Recv()
+		if err != nil {
+			if goingAway {
+				return errGoingAway
+			}
+			return err
+		}
+		if connection.GoingAway {
+			goingAway = true
+			continue
+		}
+		go relayFlow(ctx, client, connection.Id, address)
+	}
+}
+
+func relayFlow(ctx context.Context, client proto.TunnelClient, id uint64, address string) {
+	stream, cancel, err := openStream(ctx, client, id)
+	if err != nil {
+		return
+	}
+	defer cancel()
+
+	var dialer net.Dialer
+	local, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+
+	go func() {
+		// the server owns the lifetime of the flow, so once
+		// it hangs up we stop reading replies
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, err := local.Read(buffer)
+			if err != nil {
+				cancel()
+				return
+			}
+			if err := stream.Send(&proto.Chunk{Data: buffer[:n]}); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		if _, err := local.Write(chunk.Data); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package tunnel
+
+import "fmt"
+
+// protocolVersion is the version of the tunnel protocol that we speak,
+// peers that can't go as high as minProtocolVersion get turned away
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// features are the optional parts of the protocol, each side
+// announces what it supports and only uses what both do
+const (
+	featureCompression = "compression"
+	featureDrain       = "drain"
+	featureTimeouts    = "timeouts"
+	featureRenewal     = "renewal"
+	featureFlowControl = "flow-control"
+	featureForwarded   = "forwarded"
+)
+
+var supportedFeatures = []string{
+	featureCompression,
+	featureDrain,
+	featureTimeouts,
+	featureRenewal,
+	featureFlowControl,
+	featureForwarded,
+}
+
+// featureSet is the features shared with a peer
+type featureSet map[string]struct{}
+
+// newFeatureSet keeps whichever of the peer's features we support too
+func newFeatureSet(announced []string) featureSet {
+	features := make(featureSet)
+	for _, feature := range announced {
+		for _, supported := range supportedFeatures {
+			if feature == supported {
+				features[feature] = struct{}{}
+			}
+		}
+	}
+	return features
+}
+
+func (f featureSet) has(feature string) bool {
+	_, ok := f[feature]
+	return ok
+}
+
+func (f featureSet) list() []string {
+	features := make([]string, 0, len(f))
+	for _, feature := range supportedFeatures {
+		if f.has(feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// negotiateVersion picks the highest version both sides speak
+func negotiateVersion(version int) (int, error) {
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	if version < minProtocolVersion {
+		return 0, fmt.Errorf("protocol version %d is not supported, versions %d through %d are", version, minProtocolVersion, protocolVersion)
+	}
+	return version, nil
+}
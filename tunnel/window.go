@@ -0,0 +1,58 @@
+package tunnel
+
+import "context"
+
+// window is how many more data frames can be sent for a request before
+// the other side has to make room for them, it keeps a request whose
+// body isn't being read from backing up everything else on the stream
+type window chan struct{}
+
+// newWindow starts out with room for maxPendingFrames, a nil
+// window is for peers without flow control and never fills up
+func newWindow() window {
+	w := make(window, maxPendingFrames)
+	w.grant(maxPendingFrames)
+	return w
+}
+
+// grant makes room for n more frames
+func (w window) grant(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case w <- struct{}{}:
+		default:
+			// a peer can't make room for more than it started with
+			return
+		}
+	}
+}
+
+// acquire waits for room to send another frame
+func (w window) acquire(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w:
+		return nil
+	}
+}
+
+// credits counts the frames we've made room for so that they're
+// granted back to the sender in batches rather than one at a time
+type credits struct {
+	consumed int
+}
+
+// consume returns how many frames to grant, if any
+func (c *credits) consume() int {
+	c.consumed++
+	if c.consumed < maxPendingFrames/2 {
+		return 0
+	}
+	n := c.consumed
+	c.consumed = 0
+	return n
+}